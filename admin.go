@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// adminBackendInfo is the JSON view of a backend exposed by the management API.
+// Tokens are never included.
+type adminBackendInfo struct {
+	Name           string                  `json:"name"`
+	BaseURL        string                  `json:"base_url"`
+	Platform       string                  `json:"platform"`
+	Model          string                  `json:"model,omitempty"`
+	Enabled        bool                    `json:"enabled"`
+	CircuitBreaker CircuitBreakerStateInfo `json:"circuit_breaker"`
+	RateLimit      RateLimitStateInfo      `json:"rate_limit"`
+}
+
+// newAdminHandler builds the management API handler:
+//
+//	GET  /admin/backends                        list backends with breaker and cooldown state
+//	GET  /admin/backends/{name}                 show a single backend
+//	POST /admin/backends/{name}/enable          enable a backend and reset its breaker
+//	POST /admin/backends/{name}/disable         disable a backend
+//	POST /admin/backends/{name}/trip            manually open the circuit breaker
+//	POST /admin/backends/{name}/reset           close the circuit breaker
+//	POST /admin/backends/{name}/clear-cooldown  clear the 429 cooldown
+//
+// Every request must carry the configured admin token as "Authorization: Bearer <token>"
+// or "X-Admin-Token: <token>". The token is read from the current config on each
+// request, so it follows config reloads; the API answers 404 while no token is set.
+func newAdminHandler(ps *ProxyServer) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /admin/backends", func(w http.ResponseWriter, r *http.Request) {
+		backends := ps.circuitBreaker.ListBackends()
+		infos := make([]adminBackendInfo, 0, len(backends))
+		for _, backend := range backends {
+			infos = append(infos, ps.adminBackendInfo(backend))
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"backends": infos})
+	})
+
+	mux.HandleFunc("GET /admin/backends/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		for _, backend := range ps.circuitBreaker.ListBackends() {
+			if backend.Name == name {
+				writeJSON(w, http.StatusOK, ps.adminBackendInfo(backend))
+				return
+			}
+		}
+		writeAdminNotFound(w, name)
+	})
+
+	actions := map[string]func(name string) bool{
+		"enable":         ps.circuitBreaker.OnBackendEnabled,
+		"disable":        ps.circuitBreaker.OnBackendDisabled,
+		"trip":           ps.circuitBreaker.TripBackend,
+		"reset":          ps.circuitBreaker.ResetBackend,
+		"clear-cooldown": ps.circuitBreaker.ClearCooldown,
+	}
+	for action, apply := range actions {
+		mux.HandleFunc("POST /admin/backends/{name}/"+action, func(w http.ResponseWriter, r *http.Request) {
+			name := r.PathValue("name")
+			if !apply(name) {
+				writeAdminNotFound(w, name)
+				return
+			}
+			log.Printf("[管理接口] %s %s - 来自 %s", action, name, r.RemoteAddr)
+			for _, backend := range ps.circuitBreaker.ListBackends() {
+				if backend.Name == name {
+					writeJSON(w, http.StatusOK, ps.adminBackendInfo(backend))
+					return
+				}
+			}
+		})
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ps.getConfig().Admin.Token
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !adminAuthorized(r, token) {
+			log.Printf("[管理接口] 拒绝未授权请求 %s %s - 来自 %s", r.Method, r.URL.Path, r.RemoteAddr)
+			writeJSON(w, http.StatusUnauthorized, map[string]any{"error": "unauthorized"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// adminBackendInfo collects the management view of a backend
+func (ps *ProxyServer) adminBackendInfo(backend Backend) adminBackendInfo {
+	return adminBackendInfo{
+		Name:           backend.Name,
+		BaseURL:        backend.BaseURL,
+		Platform:       backend.PlatformType(),
+		Model:          backend.Model,
+		Enabled:        backend.Enabled,
+		CircuitBreaker: ps.circuitBreaker.GetBackendState(backend.Name),
+		RateLimit:      ps.circuitBreaker.GetRateLimitState(backend.Name),
+	}
+}
+
+// isAdminPath reports whether a request path belongs to the management API
+func isAdminPath(path string) bool {
+	return path == "/admin" || strings.HasPrefix(path, "/admin/")
+}
+
+// adminAuthorized checks the admin token in constant time
+func adminAuthorized(r *http.Request, token string) bool {
+	provided := r.Header.Get("X-Admin-Token")
+	if provided == "" {
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			provided = strings.TrimPrefix(auth, "Bearer ")
+		}
+	}
+	return provided != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
+
+func writeAdminNotFound(w http.ResponseWriter, name string) {
+	writeJSON(w, http.StatusNotFound, map[string]any{"error": "backend not found: " + name})
+}
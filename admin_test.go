@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuthorized(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   bool
+	}{
+		{"x-admin-token", http.Header{"X-Admin-Token": {"secret"}}, true},
+		{"bearer", http.Header{"Authorization": {"Bearer secret"}}, true},
+		{"missing", http.Header{}, false},
+		{"wrong token", http.Header{"X-Admin-Token": {"secret2"}}, false},
+		{"wrong bearer", http.Header{"Authorization": {"Bearer nope"}}, false},
+		{"empty bearer", http.Header{"Authorization": {"Bearer "}}, false},
+		{"no scheme", http.Header{"Authorization": {"secret"}}, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/admin/backends", nil)
+		r.Header = tt.header
+		if got := adminAuthorized(r, "secret"); got != tt.want {
+			t.Errorf("%s: adminAuthorized = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAdminRejectsUnauthorized(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("管理请求被转发到上游: %s", r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	_, srv := newTestProxy(t, fmt.Sprintf(`{
+		"backends": [{"name": "an", "base_url": %q, "enabled": true}],
+		"admin": {"token": "secret"}
+	}`, upstream.URL))
+
+	for token, want := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "secret": http.StatusOK} {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/admin/backends/an/disable", nil)
+		if token != "" {
+			req.Header.Set("X-Admin-Token", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("token %q: status = %d, want %d", token, resp.StatusCode, want)
+		}
+	}
+}
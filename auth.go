@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+type clientContextKey struct{}
+
+// clientCredentialHeaders are inbound credentials that must never reach an upstream provider
+var clientCredentialHeaders = []string{"Authorization", "X-Api-Key"}
+
+// defaultAnthropicVersion is sent to Anthropic backends when the client did not specify one
+const defaultAnthropicVersion = "2023-06-01"
+
+// authenticateClient checks the inbound API key from x-api-key or Authorization: Bearer.
+// Returns the matching client name, or ok=false when no configured key matches.
+// When no keys are configured every request is accepted as an anonymous client.
+func authenticateClient(r *http.Request, keys []ClientKey) (string, bool) {
+	if len(keys) == 0 {
+		return "", true
+	}
+
+	provided := r.Header.Get("X-Api-Key")
+	if provided == "" {
+		if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+			provided = strings.TrimSpace(auth[7:])
+		}
+	}
+	if provided == "" {
+		return "", false
+	}
+
+	// Compare digests so neither the key contents nor their lengths leak through timing,
+	// and check every key instead of stopping at the first match.
+	providedSum := sha256.Sum256([]byte(provided))
+	name := ""
+	matched := 0
+	for _, key := range keys {
+		keySum := sha256.Sum256([]byte(key.Key))
+		if subtle.ConstantTimeCompare(providedSum[:], keySum[:]) == 1 {
+			name = key.Name
+			matched = 1
+		}
+	}
+	return name, matched == 1
+}
+
+// withClientName stores the authenticated client name in the request context
+func withClientName(r *http.Request, name string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientContextKey{}, name))
+}
+
+// clientName returns the authenticated client name for a request, empty when anonymous
+func clientName(r *http.Request) string {
+	name, _ := r.Context().Value(clientContextKey{}).(string)
+	return name
+}
+
+// applyBackendAuth strips client credentials and attaches the backend token
+// using the scheme expected by the backend's platform:
+//   - anthropic: "x-api-key: <token>" plus anthropic-version if missing
+//   - openai: "Authorization: Bearer <token>", Anthropic-only headers removed
+//
+// auth_header and auth_scheme on the backend override the header name and token prefix.
+func applyBackendAuth(req *http.Request, backend Backend) {
+	for _, key := range clientCredentialHeaders {
+		req.Header.Del(key)
+	}
+
+	platform := backend.PlatformType()
+	header := backend.AuthHeader
+	if header == "" {
+		header = "x-api-key"
+		if platform == "openai" {
+			header = "Authorization"
+		}
+	}
+	scheme := backend.AuthScheme
+	if scheme == "" && backend.AuthHeader == "" && strings.EqualFold(header, "Authorization") {
+		scheme = "Bearer"
+	}
+
+	value := backend.Token
+	if scheme != "" {
+		value = scheme + " " + backend.Token
+	}
+	req.Header.Set(header, value)
+
+	switch platform {
+	case "anthropic":
+		if req.Header.Get("anthropic-version") == "" {
+			req.Header.Set("anthropic-version", defaultAnthropicVersion)
+		}
+	case "openai":
+		req.Header.Del("anthropic-version")
+		req.Header.Del("anthropic-beta")
+	}
+}
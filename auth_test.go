@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuthenticateClient(t *testing.T) {
+	keys := []ClientKey{{Name: "alice", Key: "key-alice"}, {Name: "ci", Key: "key-ci"}}
+	tests := []struct {
+		name   string
+		keys   []ClientKey
+		header http.Header
+		client string
+		ok     bool
+	}{
+		{"x-api-key", keys, http.Header{"X-Api-Key": {"key-ci"}}, "ci", true},
+		{"bearer", keys, http.Header{"Authorization": {"Bearer key-alice"}}, "alice", true},
+		{"bearer lowercase", keys, http.Header{"Authorization": {"bearer key-alice"}}, "alice", true},
+		{"x-api-key wins over bearer", keys, http.Header{"X-Api-Key": {"key-ci"}, "Authorization": {"Bearer key-alice"}}, "ci", true},
+		{"wrong key", keys, http.Header{"X-Api-Key": {"key-bob"}}, "", false},
+		{"key prefix", keys, http.Header{"X-Api-Key": {"key-ci-"}}, "", false},
+		{"empty bearer", keys, http.Header{"Authorization": {"Bearer "}}, "", false},
+		{"basic auth", keys, http.Header{"Authorization": {"Basic a2V5LWNp"}}, "", false},
+		{"no credentials", keys, http.Header{}, "", false},
+		{"no keys configured", nil, http.Header{}, "", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+		r.Header = tt.header
+		client, ok := authenticateClient(r, tt.keys)
+		if client != tt.client || ok != tt.ok {
+			t.Errorf("%s: authenticateClient = %q, %v; want %q, %v", tt.name, client, ok, tt.client, tt.ok)
+		}
+	}
+}
+
+func TestClientCredentialsNotForwarded(t *testing.T) {
+	var got http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"type":"message","content":[]}`)
+	}))
+	defer upstream.Close()
+
+	_, srv := newTestProxy(t, fmt.Sprintf(`{
+		"backends": [{"name": "an", "base_url": %q, "token": "backend-token", "enabled": true}],
+		"auth": {"keys": [{"name": "alice", "key": "key-alice"}]}
+	}`, upstream.URL))
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/v1/messages", strings.NewReader(`{"model":"m","messages":[]}`))
+	req.Header.Set("X-Api-Key", "key-alice")
+	req.Header.Set("Authorization", "Bearer key-alice")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if v := got.Get("X-Api-Key"); v != "backend-token" {
+		t.Errorf("上游收到 x-api-key = %q, want 后端 token", v)
+	}
+	if v := got.Get("Authorization"); v != "" {
+		t.Errorf("客户端 Authorization 被转发到上游: %q", v)
+	}
+
+	// Requests without a valid key never reach the upstream
+	got = nil
+	req, _ = http.NewRequest(http.MethodPost, srv.URL+"/v1/messages", strings.NewReader(`{"model":"m","messages":[]}`))
+	req.Header.Set("X-Api-Key", "key-bob")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || got != nil {
+		t.Errorf("错误 key: status = %d, 上游被调用 = %v", resp.StatusCode, got != nil)
+	}
+}
+
+func TestApplyBackendAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend Backend
+		header  http.Header // Expected values, "" = must be absent
+	}{
+		{"anthropic", Backend{Token: "tok"}, http.Header{
+			"X-Api-Key": {"tok"}, "Authorization": {""},
+			"Anthropic-Version": {defaultAnthropicVersion}, "Anthropic-Beta": {"tools-2024"},
+		}},
+		{"openai", Backend{Platform: "openai", Token: "tok"}, http.Header{
+			"Authorization": {"Bearer tok"}, "X-Api-Key": {""},
+			"Anthropic-Version": {""}, "Anthropic-Beta": {""},
+		}},
+		{"azure api-key", Backend{Platform: "openai", Token: "tok", AuthHeader: "api-key"}, http.Header{
+			"Api-Key": {"tok"}, "Authorization": {""}, "X-Api-Key": {""},
+		}},
+		{"authorization with scheme", Backend{Token: "tok", AuthHeader: "Authorization", AuthScheme: "Bearer"}, http.Header{
+			"Authorization": {"Bearer tok"}, "X-Api-Key": {""},
+			"Anthropic-Version": {defaultAnthropicVersion},
+		}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+		req.Header.Set("X-Api-Key", "client-key")
+		req.Header.Set("Authorization", "Bearer client-key")
+		req.Header.Set("Anthropic-Beta", "tools-2024")
+		applyBackendAuth(req, tt.backend)
+		for key, want := range tt.header {
+			if got := req.Header.Get(key); got != want[0] {
+				t.Errorf("%s: %s = %q, want %q", tt.name, key, got, want[0])
+			}
+		}
+	}
+
+	// The client's anthropic-version is kept
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	req.Header.Set("Anthropic-Version", "2024-01-01")
+	applyBackendAuth(req, Backend{Token: "tok"})
+	if got := req.Header.Get("Anthropic-Version"); got != "2024-01-01" {
+		t.Errorf("客户端的 anthropic-version 被覆盖: %q", got)
+	}
+}
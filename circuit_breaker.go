@@ -3,8 +3,10 @@ package main
 import (
 	"fmt"
 	"log"
-	"strconv"
+	"math"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,9 +17,24 @@ type BackendState struct {
 	lastFailTime     time.Time
 	lastError        string
 	circuitOpen      bool
+	openFor          time.Duration // Overrides open_timeout_seconds for this opening (DisableFor, Quarantine)
+	quarantined      bool          // Circuit opened because the backend ran out of credit/quota
+	enabledOverride  bool          // Enabled was changed via the management API and differs from the file
+	fileEnabled      bool          // Enabled as set in the config file
 	last429Time      time.Time
-	retryAfter       time.Time
+	cooldownUntil    time.Time                    // End of the 429 cooldown
+	headroom         map[string]rateLimitHeadroom // Latest rate limit headers by limit name
+	lowHeadroom      bool                         // A limit was nearly exhausted at the last update
 	halfOpenTries    int
+	inFlight         atomic.Int64
+	rpmBucket        *tokenBucket // Local limits, nil when not configured
+	tpmBucket        *tokenBucket
+}
+
+func newBackendState(backend Backend) *BackendState {
+	state := &BackendState{backend: backend, fileEnabled: backend.Enabled}
+	state.rpmBucket, state.tpmBucket = newLocalLimits(backend)
+	return state
 }
 
 // CircuitBreaker manages circuit breaker logic for all backends
@@ -25,21 +42,80 @@ type CircuitBreaker struct {
 	config  *Config
 	states  []*BackendState
 	stateMu sync.RWMutex
+	rrTick  atomic.Uint64 // Round-robin rotation counter
+
+	saveMu    sync.Mutex    // Serializes writes of the state file
+	persistCh chan struct{} // Signals persistLoop that state changed
 }
 
 // NewCircuitBreaker creates a new circuit breaker
 func NewCircuitBreaker(config *Config) *CircuitBreaker {
 	states := make([]*BackendState, len(config.Backends))
 	for i, backend := range config.Backends {
-		states[i] = &BackendState{
-			backend: backend,
-		}
+		states[i] = newBackendState(backend)
 	}
 
-	return &CircuitBreaker{
-		config: config,
-		states: states,
+	cb := &CircuitBreaker{
+		config:    config,
+		states:    states,
+		persistCh: make(chan struct{}, 1),
 	}
+	cb.loadState()
+	go cb.persistLoop()
+	return cb
+}
+
+// Reload swaps in a new configuration. States of backends whose name is unchanged
+// are kept (with their backend config updated) so breaker and cooldown history
+// survive; new backends start fresh and removed ones are dropped. Requests that
+// already hold a state pointer keep working on it until they finish.
+func (cb *CircuitBreaker) Reload(config *Config) {
+	cb.stateMu.Lock()
+	defer cb.stateMu.Unlock()
+
+	existing := make(map[string]*BackendState, len(cb.states))
+	for _, state := range cb.states {
+		existing[state.backend.Name] = state
+	}
+
+	states := make([]*BackendState, len(config.Backends))
+	for i, backend := range config.Backends {
+		if state, ok := existing[backend.Name]; ok {
+			// A runtime enable/disable survives unrelated edits; changing the
+			// backend's enabled value in the file replaces it
+			fileChanged := backend.Enabled != state.fileEnabled
+			state.fileEnabled = backend.Enabled
+			if state.enabledOverride && !fileChanged {
+				backend.Enabled = state.backend.Enabled
+			} else {
+				state.enabledOverride = false
+			}
+			if backend.RPM != state.backend.RPM || backend.TPM != state.backend.TPM {
+				state.rpmBucket, state.tpmBucket = newLocalLimits(backend)
+			}
+			state.backend = backend
+			states[i] = state
+			delete(existing, backend.Name)
+			continue
+		}
+		states[i] = newBackendState(backend)
+		log.Printf("[配置重载] 新增后端 %s", backend.Name)
+	}
+	for name := range existing {
+		log.Printf("[配置重载] 移除后端 %s", name)
+	}
+
+	cb.config = config
+	cb.states = states
+	cb.persist()
+}
+
+// Backend returns a consistent snapshot of the backend configuration for a state
+func (cb *CircuitBreaker) Backend(state *BackendState) Backend {
+	cb.stateMu.RLock()
+	defer cb.stateMu.RUnlock()
+
+	return state.backend
 }
 
 // ShouldSkipBackend checks if backend should be skipped based on circuit breaker and rate limit
@@ -52,9 +128,15 @@ func (cb *CircuitBreaker) ShouldSkipBackend(state *BackendState) (bool, string)
 	// Check circuit breaker
 	if state.circuitOpen {
 		openDuration := now.Sub(state.lastFailTime)
-		timeout := time.Duration(cb.config.Failover.CircuitBreaker.OpenTimeoutSeconds) * time.Second
+		timeout := cb.openTimeout(state)
 
 		if openDuration < timeout {
+			switch {
+			case state.quarantined && timeout == quarantineForever:
+				return true, "配额耗尽,等待手动启用"
+			case state.quarantined:
+				return true, fmt.Sprintf("配额耗尽隔离中 (还需 %.0f 秒)", timeout.Seconds()-openDuration.Seconds())
+			}
 			return true, fmt.Sprintf("熔断中 (还需 %.0f 秒)", timeout.Seconds()-openDuration.Seconds())
 		}
 
@@ -68,13 +150,10 @@ func (cb *CircuitBreaker) ShouldSkipBackend(state *BackendState) (bool, string)
 	}
 
 	// Check rate limit cooldown (429)
-	if !state.last429Time.IsZero() {
-		cooldown := time.Duration(cb.config.Failover.RateLimit.CooldownSeconds) * time.Second
-		if now.Sub(state.last429Time) < cooldown {
-			// Don't completely skip, but this backend has lower priority
-			// We'll still try it if all others fail
-			return false, ""
-		}
+	if now.Before(state.cooldownUntil) {
+		// Don't completely skip, but this backend has lower priority
+		// We'll still try it if all others fail
+		return false, ""
 	}
 
 	return false, ""
@@ -87,10 +166,13 @@ func (cb *CircuitBreaker) RecordSuccess(state *BackendState) {
 
 	if state.circuitOpen {
 		log.Printf("[熔断恢复] %s - 后端已恢复正常", state.backend.Name)
+		cb.persist()
 	}
 
 	state.consecutiveFails = 0
 	state.circuitOpen = false
+	state.openFor = 0
+	state.quarantined = false
 	state.halfOpenTries = 0
 	state.lastFailTime = time.Time{}
 }
@@ -107,13 +189,15 @@ func (cb *CircuitBreaker) RecordFailure(state *BackendState, statusCode int) {
 	if state.circuitOpen {
 		// Already open, reset half-open counter
 		state.halfOpenTries = 0
-		log.Printf("[熔断测试失败] %s - 继续熔断 %d 秒", state.backend.Name, cb.config.Failover.CircuitBreaker.OpenTimeoutSeconds)
+		cb.persist()
+		log.Printf("[熔断测试失败] %s - 继续熔断 %.0f 秒", state.backend.Name, cb.openTimeout(state).Seconds())
 		return
 	}
 
 	// Check if threshold reached
 	if state.consecutiveFails >= cb.config.Failover.CircuitBreaker.FailureThreshold {
 		state.circuitOpen = true
+		cb.persist()
 		timeout := cb.config.Failover.CircuitBreaker.OpenTimeoutSeconds
 		log.Printf("[熔断触发] %s - 连续失败 %d 次,熔断 %d 秒 (HTTP %d)",
 			state.backend.Name, state.consecutiveFails, timeout, statusCode)
@@ -137,71 +221,232 @@ func (cb *CircuitBreaker) IsHalfOpen(state *BackendState) bool {
 		return false
 	}
 
-	timeout := time.Duration(cb.config.Failover.CircuitBreaker.OpenTimeoutSeconds) * time.Second
-	return time.Since(state.lastFailTime) >= timeout
+	return time.Since(state.lastFailTime) >= cb.openTimeout(state)
 }
 
-// Record429 records a rate limit error
-func (cb *CircuitBreaker) Record429(state *BackendState, retryAfter string) {
+// DisableFor opens the circuit of a backend for d instead of open_timeout_seconds,
+// e.g. when a failover rule says its key was revoked. Half-open probing resumes
+// once d has passed; a successful probe closes the circuit as usual.
+func (cb *CircuitBreaker) DisableFor(state *BackendState, d time.Duration, reason string) {
 	cb.stateMu.Lock()
 	defer cb.stateMu.Unlock()
 
-	state.last429Time = time.Now()
+	state.circuitOpen = true
+	state.openFor = d
+	state.quarantined = false
+	state.lastFailTime = time.Now()
+	state.lastError = reason
+	state.halfOpenTries = 0
+	cb.persist()
+	log.Printf("[规则熔断] %s - %s,熔断 %.0f 秒", state.backend.Name, reason, d.Seconds())
+}
 
-	// Parse Retry-After header if present
-	if retryAfter != "" {
-		if seconds, err := strconv.Atoi(retryAfter); err == nil {
-			state.retryAfter = time.Now().Add(time.Duration(seconds) * time.Second)
-			log.Printf("[限流记录] %s - 触发 429,Retry-After: %d 秒", state.backend.Name, seconds)
-		} else {
-			log.Printf("[限流记录] %s - 触发 429,冷却 %d 秒", state.backend.Name, cb.config.Failover.RateLimit.CooldownSeconds)
-		}
+// quarantineForever keeps a quarantined backend out until it is re-enabled via the management API
+const quarantineForever = 100 * 365 * 24 * time.Hour
+
+// Quarantine takes a backend out of rotation after it reported exhausted credit
+// or quota: retrying it within minutes cannot help. d <= 0 quarantines it until
+// it is re-enabled or reset via the management API; otherwise a half-open
+// request checks it again after d.
+func (cb *CircuitBreaker) Quarantine(state *BackendState, d time.Duration, reason string) {
+	cb.stateMu.Lock()
+	defer cb.stateMu.Unlock()
+
+	state.circuitOpen = true
+	state.quarantined = true
+	state.lastFailTime = time.Now()
+	state.lastError = reason
+	state.halfOpenTries = 0
+	cb.persist()
+	if d <= 0 {
+		state.openFor = quarantineForever
+		log.Printf("[配额耗尽] %s - %s,隔离至手动启用", state.backend.Name, reason)
+		return
+	}
+	state.openFor = d
+	log.Printf("[配额耗尽] %s - %s,隔离 %.0f 秒", state.backend.Name, reason, d.Seconds())
+}
+
+// openTimeout returns how long the circuit of a backend stays open before
+// half-open probing. Caller must hold stateMu.
+func (cb *CircuitBreaker) openTimeout(state *BackendState) time.Duration {
+	if state.openFor > 0 {
+		return state.openFor
+	}
+	return time.Duration(cb.config.Failover.CircuitBreaker.OpenTimeoutSeconds) * time.Second
+}
+
+// Record429 records a rate limit error. The cooldown lasts as long as the
+// backend asked for via Retry-After or Anthropic's rate limit reset headers,
+// falling back to cooldown_seconds. header may be nil (e.g. an in-stream error).
+func (cb *CircuitBreaker) Record429(state *BackendState, header http.Header) {
+	cb.stateMu.Lock()
+	defer cb.stateMu.Unlock()
+
+	now := time.Now()
+	state.last429Time = now
+
+	delay, source, ok := rateLimitDelay(header, now)
+	if ok {
+		log.Printf("[限流记录] %s - 触发 429,%s: 冷却 %.0f 秒", state.backend.Name, source, math.Ceil(delay.Seconds()))
 	} else {
+		delay = time.Duration(cb.config.Failover.RateLimit.CooldownSeconds) * time.Second
 		log.Printf("[限流记录] %s - 触发 429,冷却 %d 秒", state.backend.Name, cb.config.Failover.RateLimit.CooldownSeconds)
 	}
+	state.cooldownUntil = now.Add(delay)
+	cb.persist()
+}
+
+// RecordRateLimitHeaders stores the remaining-capacity headers of a backend
+// response so that a backend about to run dry can be tried after the others
+// before it starts answering 429.
+func (cb *CircuitBreaker) RecordRateLimitHeaders(state *BackendState, header http.Header) {
+	now := time.Now()
+	readings := parseRateLimitHeadroom(header, now)
+	if len(readings) == 0 {
+		return
+	}
+
+	cb.stateMu.Lock()
+	defer cb.stateMu.Unlock()
+
+	if state.headroom == nil {
+		state.headroom = make(map[string]rateLimitHeadroom, len(readings))
+	}
+	for name, reading := range readings {
+		state.headroom[name] = reading
+	}
+
+	name, low := cb.nearlyExhausted(state, now)
+	if low && !state.lowHeadroom {
+		reading := state.headroom[name]
+		log.Printf("[限流预警] %s - %s 剩余 %d/%d,降低优先级", state.backend.Name, name, reading.remaining, reading.limit)
+	}
+	state.lowHeadroom = low
 }
 
-// SortBackendsByPriority returns backends sorted by priority (non-rate-limited first)
-func (cb *CircuitBreaker) SortBackendsByPriority() []*BackendState {
+// nearlyExhausted returns the first limit of a backend that is about to run dry.
+// Caller must hold stateMu.
+func (cb *CircuitBreaker) nearlyExhausted(state *BackendState, now time.Time) (string, bool) {
+	ratio := cb.config.Failover.RateLimit.LowRemainingRatio
+	for _, name := range anthropicRateLimits { // Also covers the OpenAI limit names
+		if reading, ok := state.headroom[name]; ok && reading.low(now, ratio) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// SortBackendsByPriority returns backends sorted by priority: normal backends
+// first, then those whose reported rate limit headroom is nearly exhausted,
+// then those in 429 cooldown or out of local rpm/tpm budget. Within each tier
+// backends are grouped by their priority value and ordered by the load
+// balancing strategy. A non-nil names list (from a routing rule) restricts the
+// candidates to those backends and replaces config order with the list order.
+func (cb *CircuitBreaker) SortBackendsByPriority(names []string) []*BackendState {
 	cb.stateMu.RLock()
 	defer cb.stateMu.RUnlock()
 
 	now := time.Now()
-	cooldown := time.Duration(cb.config.Failover.RateLimit.CooldownSeconds) * time.Second
 
 	normal := make([]*BackendState, 0)
+	lowHeadroom := make([]*BackendState, 0)
 	rateLimited := make([]*BackendState, 0)
 
-	for _, state := range cb.states {
+	for _, state := range cb.candidates(names) {
 		if !state.backend.Enabled {
 			continue
 		}
 
-		// Check if in rate limit cooldown
-		if !state.last429Time.IsZero() && now.Sub(state.last429Time) < cooldown {
+		// Check if in rate limit cooldown or about to run into it
+		if now.Before(state.cooldownUntil) || localLimitWait(state, now) > 0 {
 			rateLimited = append(rateLimited, state)
+		} else if _, low := cb.nearlyExhausted(state, now); low {
+			lowHeadroom = append(lowHeadroom, state)
 		} else {
 			normal = append(normal, state)
 		}
 	}
 
-	// Normal backends first, then rate-limited ones
-	result := append(normal, rateLimited...)
+	rrTick := cb.rrTick.Add(1) - 1
+	cb.orderBackends(normal, rrTick)
+	cb.orderBackends(lowHeadroom, rrTick)
+	cb.orderBackends(rateLimited, rrTick)
+
+	// Normal backends first, then nearly exhausted ones, then rate-limited ones
+	result := append(normal, lowHeadroom...)
+	result = append(result, rateLimited...)
 	return result
 }
 
+// candidates returns the states a request may use: all backends, or those
+// named by a routing rule in the rule's order. Caller must hold stateMu.
+func (cb *CircuitBreaker) candidates(names []string) []*BackendState {
+	if names == nil {
+		return cb.states
+	}
+	candidates := make([]*BackendState, 0, len(names))
+	for _, name := range names {
+		for _, state := range cb.states {
+			if state.backend.Name == name {
+				candidates = append(candidates, state)
+				break
+			}
+		}
+	}
+	return candidates
+}
+
+// NextAvailable returns how long until the first of the candidate backends
+// can be tried again: its circuit reaches half-open, its 429 cooldown ends or
+// its local rpm/tpm budget refills. ok is false when no candidate is enabled.
+func (cb *CircuitBreaker) NextAvailable(names []string) (time.Duration, bool) {
+	cb.stateMu.RLock()
+	defer cb.stateMu.RUnlock()
+
+	now := time.Now()
+	soonest, found := time.Duration(0), false
+	for _, state := range cb.candidates(names) {
+		if !state.backend.Enabled || (state.quarantined && state.openFor == quarantineForever) {
+			continue
+		}
+		var wait time.Duration
+		if state.circuitOpen {
+			wait = max(wait, state.lastFailTime.Add(cb.openTimeout(state)).Sub(now))
+		}
+		wait = max(wait, state.cooldownUntil.Sub(now), localLimitWait(state, now))
+		if !found || wait < soonest {
+			soonest, found = wait, true
+		}
+	}
+	if !found {
+		return 0, false
+	}
+	return clampDelay(soonest), true
+}
+
 // CircuitBreakerStateInfo represents circuit breaker state information
 type CircuitBreakerStateInfo struct {
-	State               string
-	ConsecutiveFailures int
-	LastFailureTime     time.Time
-	LastError           string
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastFailureTime     time.Time  `json:"last_failure_time"`
+	LastError           string     `json:"last_error,omitempty"`
+	QuarantinedUntil    *time.Time `json:"quarantined_until,omitempty"` // Unset while quarantined until re-enabled
 }
 
 // RateLimitStateInfo represents rate limit state information
 type RateLimitStateInfo struct {
-	CooldownUntil *time.Time
-	RetryAfter    int
+	CooldownUntil   *time.Time                    `json:"cooldown_until,omitempty"`
+	RetryAfter      int                           `json:"retry_after_seconds"`
+	NearlyExhausted bool                          `json:"nearly_exhausted"`
+	Limits          map[string]RateLimitLimitInfo `json:"limits,omitempty"` // Latest rate limit headers by limit name
+}
+
+// RateLimitLimitInfo is the last reported state of one backend rate limit
+type RateLimitLimitInfo struct {
+	Limit     int64      `json:"limit,omitempty"`
+	Remaining int64      `json:"remaining"`
+	ResetAt   *time.Time `json:"reset_at,omitempty"`
 }
 
 // GetBackendState returns the circuit breaker state for a backend by name
@@ -212,11 +457,18 @@ func (cb *CircuitBreaker) GetBackendState(name string) CircuitBreakerStateInfo {
 	for _, state := range cb.states {
 		if state.backend.Name == name {
 			stateStr := "closed"
+			var quarantinedUntil *time.Time
 			if state.circuitOpen {
-				timeout := time.Duration(cb.config.Failover.CircuitBreaker.OpenTimeoutSeconds) * time.Second
-				if time.Since(state.lastFailTime) >= timeout {
+				switch {
+				case time.Since(state.lastFailTime) >= cb.openTimeout(state):
 					stateStr = "half-open"
-				} else {
+				case state.quarantined:
+					stateStr = "quarantined"
+					if state.openFor != quarantineForever {
+						until := state.lastFailTime.Add(state.openFor)
+						quarantinedUntil = &until
+					}
+				default:
 					stateStr = "open"
 				}
 			}
@@ -226,6 +478,7 @@ func (cb *CircuitBreaker) GetBackendState(name string) CircuitBreakerStateInfo {
 				ConsecutiveFailures: state.consecutiveFails,
 				LastFailureTime:     state.lastFailTime,
 				LastError:           state.lastError,
+				QuarantinedUntil:    quarantinedUntil,
 			}
 		}
 	}
@@ -240,21 +493,37 @@ func (cb *CircuitBreaker) GetRateLimitState(name string) RateLimitStateInfo {
 
 	for _, state := range cb.states {
 		if state.backend.Name == name {
+			now := time.Now()
 			var cooldownUntil *time.Time
 			retryAfter := 0
 
-			if !state.last429Time.IsZero() {
-				cooldown := time.Duration(cb.config.Failover.RateLimit.CooldownSeconds) * time.Second
-				until := state.last429Time.Add(cooldown)
-				if time.Now().Before(until) {
-					cooldownUntil = &until
-					retryAfter = int(time.Until(until).Seconds())
+			if until := state.cooldownUntil; now.Before(until) {
+				cooldownUntil = &until
+				retryAfter = int(math.Ceil(until.Sub(now).Seconds()))
+			}
+
+			var limits map[string]RateLimitLimitInfo
+			for name, reading := range state.headroom {
+				if !reading.current(now) {
+					continue
+				}
+				if limits == nil {
+					limits = make(map[string]RateLimitLimitInfo)
 				}
+				info := RateLimitLimitInfo{Limit: reading.limit, Remaining: reading.remaining}
+				if !reading.reset.IsZero() {
+					reset := reading.reset
+					info.ResetAt = &reset
+				}
+				limits[name] = info
 			}
+			_, low := cb.nearlyExhausted(state, now)
 
 			return RateLimitStateInfo{
-				CooldownUntil: cooldownUntil,
-				RetryAfter:    retryAfter,
+				CooldownUntil:   cooldownUntil,
+				RetryAfter:      retryAfter,
+				NearlyExhausted: low,
+				Limits:          limits,
 			}
 		}
 	}
@@ -262,34 +531,115 @@ func (cb *CircuitBreaker) GetRateLimitState(name string) RateLimitStateInfo {
 	return RateLimitStateInfo{}
 }
 
+// ListBackends returns a copy of every backend's configuration including its runtime enabled flag
+func (cb *CircuitBreaker) ListBackends() []Backend {
+	cb.stateMu.RLock()
+	defer cb.stateMu.RUnlock()
+
+	backends := make([]Backend, len(cb.states))
+	for i, state := range cb.states {
+		backends[i] = state.backend
+	}
+	return backends
+}
+
 // OnBackendEnabled is called when a backend is enabled via management API
-func (cb *CircuitBreaker) OnBackendEnabled(name string) {
+func (cb *CircuitBreaker) OnBackendEnabled(name string) bool {
 	cb.stateMu.Lock()
 	defer cb.stateMu.Unlock()
 
 	for _, state := range cb.states {
 		if state.backend.Name == name {
 			state.backend.Enabled = true
+			state.enabledOverride = !state.fileEnabled
 			// Reset circuit breaker state when enabling
 			state.consecutiveFails = 0
 			state.circuitOpen = false
+			state.openFor = 0
+			state.quarantined = false
 			state.halfOpenTries = 0
+			cb.persist()
 			log.Printf("[后端启用] %s - 已启用并重置熔断状态", name)
-			return
+			return true
 		}
 	}
+	return false
 }
 
 // OnBackendDisabled is called when a backend is disabled via management API
-func (cb *CircuitBreaker) OnBackendDisabled(name string) {
+func (cb *CircuitBreaker) OnBackendDisabled(name string) bool {
 	cb.stateMu.Lock()
 	defer cb.stateMu.Unlock()
 
 	for _, state := range cb.states {
 		if state.backend.Name == name {
 			state.backend.Enabled = false
+			state.enabledOverride = state.fileEnabled
+			cb.persist()
 			log.Printf("[后端禁用] %s - 已禁用", name)
-			return
+			return true
+		}
+	}
+	return false
+}
+
+// TripBackend manually opens the circuit breaker for a backend via management API
+func (cb *CircuitBreaker) TripBackend(name string) bool {
+	cb.stateMu.Lock()
+	defer cb.stateMu.Unlock()
+
+	for _, state := range cb.states {
+		if state.backend.Name == name {
+			state.circuitOpen = true
+			state.openFor = 0
+			state.quarantined = false
+			state.lastFailTime = time.Now()
+			state.lastError = "手动熔断"
+			state.halfOpenTries = 0
+			cb.persist()
+			log.Printf("[手动熔断] %s - 熔断 %d 秒", name, cb.config.Failover.CircuitBreaker.OpenTimeoutSeconds)
+			return true
+		}
+	}
+	return false
+}
+
+// ResetBackend closes the circuit breaker for a backend via management API
+func (cb *CircuitBreaker) ResetBackend(name string) bool {
+	cb.stateMu.Lock()
+	defer cb.stateMu.Unlock()
+
+	for _, state := range cb.states {
+		if state.backend.Name == name {
+			state.consecutiveFails = 0
+			state.circuitOpen = false
+			state.openFor = 0
+			state.quarantined = false
+			state.halfOpenTries = 0
+			state.lastFailTime = time.Time{}
+			cb.persist()
+			log.Printf("[熔断重置] %s - 已手动重置熔断状态", name)
+			return true
+		}
+	}
+	return false
+}
+
+// ClearCooldown clears the 429 cooldown for a backend via management API
+func (cb *CircuitBreaker) ClearCooldown(name string) bool {
+	cb.stateMu.Lock()
+	defer cb.stateMu.Unlock()
+
+	for _, state := range cb.states {
+		if state.backend.Name == name {
+			state.last429Time = time.Time{}
+			state.cooldownUntil = time.Time{}
+			state.headroom = nil
+			state.lowHeadroom = false
+			cb.persist()
+			log.Printf("[限流清除] %s - 已手动清除 429 冷却", name)
+			return true
 		}
 	}
+	return false
 }
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func testBreakerConfig(aEnabled bool, bToken string) *Config {
+	config := &Config{}
+	config.Backends = []Backend{
+		{Name: "a", Enabled: aEnabled},
+		{Name: "b", Enabled: true, Token: bToken},
+	}
+	config.Failover.CircuitBreaker.OpenTimeoutSeconds = 60
+	return config
+}
+
+func TestReloadKeepsEnableOverride(t *testing.T) {
+	cb := NewCircuitBreaker(testBreakerConfig(true, "token-1"))
+	cb.OnBackendDisabled("a")
+
+	// Rotating another backend's token must not undo the runtime disable
+	cb.Reload(testBreakerConfig(true, "token-2"))
+	if cb.ListBackends()[0].Enabled {
+		t.Fatal("无关的配置修改撤销了运行时禁用")
+	}
+
+	// Changing the backend's own enabled value in the file replaces it
+	cb.Reload(testBreakerConfig(false, "token-2"))
+	cb.Reload(testBreakerConfig(true, "token-2"))
+	if !cb.ListBackends()[0].Enabled {
+		t.Fatal("配置文件的 enabled 变更未生效")
+	}
+}
+
+func TestEnableMatchingFileDropsOverride(t *testing.T) {
+	cb := NewCircuitBreaker(testBreakerConfig(true, "token-1"))
+	cb.OnBackendDisabled("a")
+	cb.OnBackendEnabled("a")
+
+	// Back at the file value: a later edit of the file applies directly
+	cb.Reload(testBreakerConfig(true, "token-1"))
+	cb.Reload(testBreakerConfig(false, "token-1"))
+	if cb.ListBackends()[0].Enabled {
+		t.Fatal("恢复为文件值后覆盖未清除")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// clientLimitPruneInterval is how often idle client entries are dropped
+const clientLimitPruneInterval = time.Minute
+
+// clientLimiter enforces client_limits per inbound client, so one runaway
+// client cannot exhaust the shared backend pool
+type clientLimiter struct {
+	mu        sync.Mutex
+	clients   map[string]*clientUsage
+	lastPrune time.Time
+}
+
+// clientUsage is the live usage of one inbound client
+type clientUsage struct {
+	requests *tokenBucket // nil when rpm is unlimited
+	inFlight int
+	streams  int
+}
+
+// clientLimitError describes why a client request was rejected
+type clientLimitError struct {
+	message    string
+	retryAfter time.Duration
+}
+
+func (e *clientLimitError) Error() string { return e.message }
+
+func newClientLimiter() *clientLimiter {
+	return &clientLimiter{clients: make(map[string]*clientUsage)}
+}
+
+func (c ClientLimits) valid() bool {
+	return c.RPM >= 0 && c.MaxConcurrent >= 0 && c.MaxStreams >= 0
+}
+
+// limitsFor returns the limits of a client: its key's own limits if set, else the defaults
+func limitsFor(config *Config, client string) ClientLimits {
+	for _, key := range config.Auth.Keys {
+		if key.Name == client && key.Limits != nil {
+			return *key.Limits
+		}
+	}
+	return config.ClientLimits
+}
+
+// clientLimitKey identifies the inbound client: the API key name when inbound
+// authentication is on, otherwise the source IP
+func clientLimitKey(r *http.Request) string {
+	if name := clientName(r); name != "" {
+		return "key:" + name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// acquire admits a request for a client or explains why not. The returned
+// release function must be called when the request has finished.
+func (l *clientLimiter) acquire(key string, limits ClientLimits, stream bool) (func(), *clientLimitError) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	usage, ok := l.clients[key]
+	if !ok {
+		usage = &clientUsage{}
+		l.clients[key] = usage
+	}
+	// Limits may change on reload; a new rpm starts with a full bucket
+	if limits.RPM <= 0 {
+		usage.requests = nil
+	} else if usage.requests == nil || usage.requests.capacity != float64(limits.RPM) {
+		usage.requests = newTokenBucket(limits.RPM)
+	}
+
+	if limits.MaxConcurrent > 0 && usage.inFlight >= limits.MaxConcurrent {
+		return nil, &clientLimitError{
+			message:    fmt.Sprintf("too many concurrent requests for this client (max %d)", limits.MaxConcurrent),
+			retryAfter: time.Second,
+		}
+	}
+	if stream && limits.MaxStreams > 0 && usage.streams >= limits.MaxStreams {
+		return nil, &clientLimitError{
+			message:    fmt.Sprintf("too many concurrent streaming requests for this client (max %d)", limits.MaxStreams),
+			retryAfter: time.Second,
+		}
+	}
+	if usage.requests != nil {
+		if wait := usage.requests.waitFor(1, now); wait > 0 {
+			return nil, &clientLimitError{
+				message:    fmt.Sprintf("request rate limit exceeded for this client (%d requests per minute)", limits.RPM),
+				retryAfter: wait,
+			}
+		}
+		usage.requests.take(1, now)
+	}
+
+	usage.inFlight++
+	if stream {
+		usage.streams++
+	}
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		usage.inFlight--
+		if stream {
+			usage.streams--
+		}
+	}, nil
+}
+
+// prune drops clients that are idle and would start over in the same state.
+// Caller must hold mu.
+func (l *clientLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < clientLimitPruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for key, usage := range l.clients {
+		if usage.inFlight == 0 && (usage.requests == nil || usage.requests.available(now) >= usage.requests.capacity) {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// writeClientLimitError rejects a request in the Anthropic rate limit format,
+// with Retry-After so that SDK clients back off on their own
+func writeClientLimitError(w http.ResponseWriter, err *clientLimitError) {
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(err.retryAfter.Seconds()))))
+	writeAnthropicError(w, http.StatusTooManyRequests, "rate_limit_error", err.message)
+}
@@ -1,13 +1,109 @@
 package main
 
+import "regexp"
+
 // Backend represents an API backend configuration
 type Backend struct {
 	Name     string `json:"name"`
 	BaseURL  string `json:"base_url"`
 	Enabled  bool   `json:"enabled"`
 	Token    string `json:"token"`
-	Model    string `json:"model,omitempty"` // Optional: override model field in request
+	Model    string `json:"model,omitempty"`    // Optional: override model field in request
 	Platform string `json:"platform,omitempty"` // Platform type: "anthropic" (default) or "openai"
+
+	// Optional: override how the token is sent. Defaults to "x-api-key: <token>" for
+	// anthropic and "Authorization: Bearer <token>" for openai.
+	AuthHeader string `json:"auth_header,omitempty"` // e.g. "api-key" for Azure OpenAI
+	AuthScheme string `json:"auth_scheme,omitempty"` // Token prefix such as "Bearer"; empty sends the raw token
+
+	// Load balancing: lower priority groups are tried first; weight biases
+	// weighted-random and least-in-flight within a group
+	Priority int `json:"priority,omitempty"`
+	Weight   int `json:"weight,omitempty"` // Defaults to 1
+
+	// Optional: per-backend overrides of retry.timeout_seconds and
+	// streaming.first_byte_timeout_seconds (-1 disables the first byte timeout)
+	Timeout          int `json:"timeout_seconds,omitempty"`
+	FirstByteTimeout int `json:"first_byte_timeout_seconds,omitempty"`
+
+	// Optional: local requests/tokens per minute limits, enforced before sending
+	RPM int `json:"rpm,omitempty"`
+	TPM int `json:"tpm,omitempty"`
+
+	Transport BackendTransport `json:"transport"`
+}
+
+// BackendTransport tunes the HTTP connection to one backend; zero values keep Go's defaults
+type BackendTransport struct {
+	DialTimeout         int    `json:"dial_timeout_seconds,omitempty"`
+	TLSHandshakeTimeout int    `json:"tls_handshake_timeout_seconds,omitempty"`
+	MaxIdleConns        int    `json:"max_idle_conns,omitempty"`
+	HTTP2               *bool  `json:"http2,omitempty"`            // Defaults to true
+	CAFile              string `json:"ca_file,omitempty"`          // PEM bundle trusted in addition to the system roots
+	ClientCertFile      string `json:"client_cert_file,omitempty"` // PEM client certificate for mTLS
+	ClientKeyFile       string `json:"client_key_file,omitempty"`
+	ProxyURL            string `json:"proxy_url,omitempty"` // http://, https:// or socks5://; default uses HTTP(S)_PROXY
+}
+
+// PlatformType returns the backend platform, defaulting to "anthropic"
+func (b Backend) PlatformType() string {
+	if b.Platform == "" {
+		return "anthropic"
+	}
+	return b.Platform
+}
+
+// backend returns the configuration of the named backend
+func (c *Config) backend(name string) (Backend, bool) {
+	for _, backend := range c.Backends {
+		if backend.Name == name {
+			return backend, true
+		}
+	}
+	return Backend{}, false
+}
+
+// ClientKey is an inbound API key accepted by the proxy
+type ClientKey struct {
+	Name   string        `json:"name"` // Identifies the client in logs
+	Key    string        `json:"key"`
+	Limits *ClientLimits `json:"limits,omitempty"` // Optional: replaces client_limits for this key
+}
+
+// ClientLimits caps what one inbound client may use; zero values mean unlimited
+type ClientLimits struct {
+	RPM           int `json:"rpm,omitempty"`            // Requests per minute
+	MaxConcurrent int `json:"max_concurrent,omitempty"` // Requests in flight at once
+	MaxStreams    int `json:"max_streams,omitempty"`    // Streaming requests in flight at once
+}
+
+// Route selects an ordered subset of backends for requests matching all of its conditions
+type Route struct {
+	Name         string     `json:"name"`
+	Match        RouteMatch `json:"match"`
+	Backends     []string   `json:"backends,omitempty"`      // Backend names in the order to try; empty = all backends
+	RewriteModel string     `json:"rewrite_model,omitempty"` // Optional: replace the request model before per-backend overrides
+
+	matcher *routeMatcher // Compiled by loadConfig
+}
+
+// RouteMatch holds the conditions of a route; empty conditions match everything
+type RouteMatch struct {
+	Model      string            `json:"model,omitempty"`       // Glob on the request model, e.g. "claude-*haiku*"
+	ModelRegex string            `json:"model_regex,omitempty"` // Regular expression on the request model
+	Path       string            `json:"path,omitempty"`        // Glob on the request path, e.g. "/v1/messages*"
+	Headers    map[string]string `json:"headers,omitempty"`     // Header name → glob on its value
+}
+
+// FailoverRule decides what happens to a matching 4xx backend response other than 429
+type FailoverRule struct {
+	Name           string `json:"name"`
+	Status         []int  `json:"status,omitempty"`          // Status codes the rule applies to; empty = any 4xx
+	BodyPattern    string `json:"body_pattern,omitempty"`    // Regular expression on the response body; empty = any body
+	Action         string `json:"action"`                    // return, failover or disable
+	DisableSeconds int    `json:"disable_seconds,omitempty"` // How long "disable" opens the circuit, default 3600
+
+	pattern *regexp.Regexp // Compiled by loadConfig
 }
 
 // Config represents configuration file structure
@@ -15,9 +111,23 @@ type Config struct {
 	Port     int       `json:"port"`
 	Backends []Backend `json:"backends"`
 	Retry    struct {
-		MaxAttempts int `json:"max_attempts"`
-		Timeout     int `json:"timeout_seconds"`
+		MaxAttempts        int `json:"max_attempts"`             // Total upstream attempts per request
+		Timeout            int `json:"timeout_seconds"`          // Per-attempt timeout for non-streaming requests
+		SameBackendRetries int `json:"same_backend_retries"`     // Retries on the same backend after a network error
+		BackoffInitialMs   int `json:"backoff_initial_ms"`       // First same-backend retry delay
+		BackoffMaxMs       int `json:"backoff_max_ms"`           // Upper bound for the retry delay
+		RequestDeadline    int `json:"request_deadline_seconds"` // Overall failover budget per request, 0 = unlimited
 	} `json:"retry"`
+	Streaming struct {
+		FailoverBufferBytes int `json:"failover_buffer_bytes"`      // Hold back up to this much of a stream before the first content event, -1 = no buffering
+		FailoverBufferMs    int `json:"failover_buffer_ms"`         // Stop holding back after this long, 0 = wait for content
+		FirstByteTimeout    int `json:"first_byte_timeout_seconds"` // From sending the request to the first body byte, -1 = disabled
+		IdleTimeout         int `json:"idle_timeout_seconds"`       // Longest gap between stream chunks, -1 = disabled
+	} `json:"streaming"`
+	Routes        []Route `json:"routes"` // First matching route wins; unmatched requests use all backends
+	LoadBalancing struct {
+		Strategy string `json:"strategy"` // priority (default), round-robin, weighted-random, least-in-flight
+	} `json:"load_balancing"`
 	Failover struct {
 		CircuitBreaker struct {
 			FailureThreshold   int `json:"failure_threshold"`
@@ -25,7 +135,33 @@ type Config struct {
 			HalfOpenRequests   int `json:"half_open_requests"`
 		} `json:"circuit_breaker"`
 		RateLimit struct {
-			CooldownSeconds int `json:"cooldown_seconds"`
+			CooldownSeconds   int     `json:"cooldown_seconds"`
+			LowRemainingRatio float64 `json:"low_remaining_ratio"` // Deprioritize a backend once at most this share of a limit is left, -1 = disabled
+			QueueTimeoutMs    int     `json:"queue_timeout_ms"`    // How long a request may wait for a backend's local rpm/tpm budget, 0 = move on
 		} `json:"rate_limit"`
+		Quota struct {
+			QuarantineSeconds int      `json:"quarantine_seconds"` // How long a backend out of credit/quota is skipped, -1 = until re-enabled
+			Patterns          []string `json:"patterns"`           // Extra regular expressions on error bodies that mean quota exhaustion
+
+			patterns []*regexp.Regexp // Built-in and extra patterns, compiled by loadConfig
+		} `json:"quota"`
+		Rules []FailoverRule `json:"rules"` // First matching rule wins; unmatched 4xx are returned to the client
 	} `json:"failover"`
+	Auth struct {
+		Keys []ClientKey `json:"keys"` // Inbound authentication is disabled when empty
+	} `json:"auth"`
+	ClientLimits ClientLimits `json:"client_limits"` // Per client: API key name, or source IP without auth.keys
+	Metrics      struct {
+		Enabled bool   `json:"enabled"`
+		Path    string `json:"path"` // Served on the proxy port, default /metrics
+	} `json:"metrics"`
+	Admin struct {
+		Token string `json:"token"`          // Management API is disabled when empty
+		Port  int    `json:"port,omitempty"` // Optional separate listener; default is /admin/ on the proxy port
+	} `json:"admin"`
+	Logging struct {
+		Level  string `json:"level"`  // debug, info, warn or error (default info)
+		Format string `json:"format"` // json (default) or text
+	} `json:"logging"`
+	StateFile string `json:"state_file"` // Optional: keep breaker, cooldown and enable/disable state across restarts
 }
@@ -3,7 +3,9 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
+	"regexp"
 )
 
 // loadConfig loads and validates configuration from file
@@ -22,6 +24,101 @@ func loadConfig(configPath string) (*Config, error) {
 		return nil, fmt.Errorf("配置文件中至少需要一个后端")
 	}
 
+	// Backend names identify runtime state across reloads and in the management API
+	names := make(map[string]bool, len(config.Backends))
+	for i, backend := range config.Backends {
+		if backend.Name == "" {
+			return nil, fmt.Errorf("第 %d 个后端缺少 name", i+1)
+		}
+		if names[backend.Name] {
+			return nil, fmt.Errorf("后端名称重复: %s", backend.Name)
+		}
+		names[backend.Name] = true
+		if _, err := url.Parse(backend.BaseURL); err != nil || backend.BaseURL == "" {
+			return nil, fmt.Errorf("后端 %s 的 base_url 无效: %q", backend.Name, backend.BaseURL)
+		}
+		if backend.Weight < 0 {
+			return nil, fmt.Errorf("后端 %s 的 weight 不能为负数", backend.Name)
+		}
+		if backend.Weight == 0 {
+			config.Backends[i].Weight = 1
+		}
+		if backend.RPM < 0 || backend.TPM < 0 {
+			return nil, fmt.Errorf("后端 %s 的 rpm/tpm 不能为负数", backend.Name)
+		}
+	}
+
+	for i := range config.Routes {
+		route := &config.Routes[i]
+		if route.Name == "" {
+			route.Name = fmt.Sprintf("route-%d", i+1)
+		}
+		for _, name := range route.Backends {
+			if !names[name] {
+				return nil, fmt.Errorf("路由 %s 引用了不存在的后端: %s", route.Name, name)
+			}
+		}
+		matcher, err := compileRouteMatch(route.Match)
+		if err != nil {
+			return nil, fmt.Errorf("路由 %s 的匹配规则无效: %w", route.Name, err)
+		}
+		route.matcher = matcher
+	}
+
+	if config.Failover.Quota.QuarantineSeconds == 0 {
+		config.Failover.Quota.QuarantineSeconds = 6 * 3600
+	}
+	config.Failover.Quota.patterns = append([]*regexp.Regexp{}, quotaPatterns...)
+	for _, pattern := range config.Failover.Quota.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failover.quota.patterns 无效: %w", err)
+		}
+		config.Failover.Quota.patterns = append(config.Failover.Quota.patterns, re)
+	}
+
+	for i := range config.Failover.Rules {
+		rule := &config.Failover.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if err := compileFailoverRule(rule); err != nil {
+			return nil, fmt.Errorf("故障转移规则 %s 无效: %w", rule.Name, err)
+		}
+	}
+
+	switch config.LoadBalancing.Strategy {
+	case "":
+		config.LoadBalancing.Strategy = StrategyPriority
+	case StrategyPriority, StrategyRoundRobin, StrategyWeightedRandom, StrategyLeastInFlight:
+	default:
+		return nil, fmt.Errorf("未知的负载均衡策略: %q", config.LoadBalancing.Strategy)
+	}
+
+	for i := range config.Auth.Keys {
+		if config.Auth.Keys[i].Key == "" {
+			return nil, fmt.Errorf("auth.keys 第 %d 项缺少 key", i+1)
+		}
+		if config.Auth.Keys[i].Name == "" {
+			config.Auth.Keys[i].Name = fmt.Sprintf("client-%d", i+1)
+		}
+		if limits := config.Auth.Keys[i].Limits; limits != nil && !limits.valid() {
+			return nil, fmt.Errorf("auth.keys 第 %d 项的 limits 不能为负数", i+1)
+		}
+	}
+	if !config.ClientLimits.valid() {
+		return nil, fmt.Errorf("client_limits 不能为负数")
+	}
+	// The placeholders once shipped in config.example.json are public knowledge
+	for _, key := range config.Auth.Keys {
+		if key.Key == "change-me-client-key" {
+			return nil, fmt.Errorf("auth.keys 中的 %s 不能使用示例占位值,请设置随机 key", key.Name)
+		}
+	}
+	if config.Admin.Token == "change-me-admin-token" {
+		return nil, fmt.Errorf("admin.token 不能使用示例占位值,请设置随机令牌或留空以关闭管理接口")
+	}
+
 	// Set default values
 	if config.Port == 0 {
 		config.Port = 8080
@@ -35,6 +132,23 @@ func loadConfig(configPath string) (*Config, error) {
 		config.Retry.Timeout = 30
 	}
 
+	if config.Retry.BackoffInitialMs == 0 {
+		config.Retry.BackoffInitialMs = 200
+	}
+	if config.Retry.BackoffMaxMs == 0 {
+		config.Retry.BackoffMaxMs = 2000
+	}
+
+	if config.Streaming.FailoverBufferBytes == 0 {
+		config.Streaming.FailoverBufferBytes = 64 * 1024
+	}
+	if config.Streaming.FirstByteTimeout == 0 {
+		config.Streaming.FirstByteTimeout = 60
+	}
+	if config.Streaming.IdleTimeout == 0 {
+		config.Streaming.IdleTimeout = 120
+	}
+
 	// Set default failover config
 	if config.Failover.CircuitBreaker.FailureThreshold == 0 {
 		config.Failover.CircuitBreaker.FailureThreshold = 3
@@ -48,6 +162,30 @@ func loadConfig(configPath string) (*Config, error) {
 	if config.Failover.RateLimit.CooldownSeconds == 0 {
 		config.Failover.RateLimit.CooldownSeconds = 60
 	}
+	if config.Failover.RateLimit.LowRemainingRatio == 0 {
+		config.Failover.RateLimit.LowRemainingRatio = 0.05
+	}
+	if config.Failover.RateLimit.LowRemainingRatio > 1 {
+		return nil, fmt.Errorf("failover.rate_limit.low_remaining_ratio 不能大于 1")
+	}
+
+	if config.Metrics.Path == "" {
+		config.Metrics.Path = "/metrics"
+	}
+
+	if _, err := parseLogLevel(config.Logging.Level); err != nil {
+		return nil, err
+	}
+	if config.Logging.Level == "" {
+		config.Logging.Level = "info"
+	}
+	switch config.Logging.Format {
+	case "":
+		config.Logging.Format = "json"
+	case "json", "text":
+	default:
+		return nil, fmt.Errorf("未知的日志格式: %q", config.Logging.Format)
+	}
 
 	return &config, nil
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Failover rule actions for 4xx backend responses
+const (
+	FailoverActionReturn   = "return"   // Pass the response to the client (default for unmatched 4xx)
+	FailoverActionFailover = "failover" // Try the next backend; the backend stays healthy
+	FailoverActionDisable  = "disable"  // Try the next backend and open its circuit for disable_seconds
+)
+
+// quotaPatterns match provider errors that mean the account is out of credit
+// or quota (Anthropic, OpenAI, OpenRouter-style gateways)
+var quotaPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)credit balance is too low`),
+	regexp.MustCompile(`insufficient_quota`),
+	regexp.MustCompile(`(?i)exceeded your current quota`),
+	regexp.MustCompile(`(?i)insufficient (credits|balance)`),
+}
+
+// isQuotaExhausted reports whether a 4xx response says the backend account is
+// out of credit or quota: 402 Payment Required, or a body matching patterns
+func isQuotaExhausted(status int, body []byte, patterns []*regexp.Regexp) bool {
+	if status == http.StatusPaymentRequired {
+		return true
+	}
+	for _, re := range patterns {
+		if re.Match(body) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileFailoverRule validates a rule and compiles its body pattern once at load time
+func compileFailoverRule(rule *FailoverRule) error {
+	for _, status := range rule.Status {
+		if status < 400 || status > 499 || status == http.StatusTooManyRequests {
+			return fmt.Errorf("status 只能是 429 以外的 4xx: %d", status)
+		}
+	}
+	switch rule.Action {
+	case FailoverActionReturn, FailoverActionFailover:
+	case FailoverActionDisable:
+		if rule.DisableSeconds == 0 {
+			rule.DisableSeconds = 3600
+		}
+	default:
+		return fmt.Errorf("未知的 action: %q", rule.Action)
+	}
+	if rule.DisableSeconds < 0 {
+		return fmt.Errorf("disable_seconds 不能为负数")
+	}
+	if rule.BodyPattern != "" {
+		re, err := regexp.Compile(rule.BodyPattern)
+		if err != nil {
+			return fmt.Errorf("body_pattern: %w", err)
+		}
+		rule.pattern = re
+	}
+	return nil
+}
+
+// matches reports whether a 4xx response falls under the rule
+func (rule *FailoverRule) matches(status int, body []byte) bool {
+	if len(rule.Status) > 0 {
+		found := false
+		for _, s := range rule.Status {
+			if s == status {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return rule.pattern == nil || rule.pattern.Match(body)
+}
+
+// matchFailoverRule returns the first rule matching a 4xx response, or nil
+func matchFailoverRule(rules []FailoverRule, status int, body []byte) *FailoverRule {
+	for i := range rules {
+		if rules[i].matches(status, body) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// rejectedResponse returns the response to pass on when every attempt was a
+// 4xx that failover rules sent elsewhere: no backend accepted the request, so
+// the client gets the last rejection instead of a generic error
+func rejectedResponse(failures []error) *http.Response {
+	if len(failures) == 0 {
+		return nil
+	}
+	for _, err := range failures {
+		var statusErr *upstreamStatusError
+		if !errors.As(err, &statusErr) || statusErr.rejected == nil {
+			return nil
+		}
+	}
+	var last *upstreamStatusError
+	errors.As(failures[len(failures)-1], &last)
+	return last.rejected
+}
+
+// disableDuration returns how long a "disable" rule keeps the backend's circuit open
+func (rule *FailoverRule) disableDuration() time.Duration {
+	return time.Duration(rule.DisableSeconds) * time.Second
+}
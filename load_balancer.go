@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"sort"
+)
+
+// Load balancing strategies for ordering backends within a priority group
+const (
+	StrategyPriority       = "priority"        // Config order
+	StrategyRoundRobin     = "round-robin"     // Rotate the starting backend on every request
+	StrategyWeightedRandom = "weighted-random" // Random order biased by weight
+	StrategyLeastInFlight  = "least-in-flight" // Fewest in-flight requests per unit of weight first
+)
+
+// orderBackends sorts a tier of backends into priority groups (lowest priority
+// value first) and orders each group with the configured strategy. The full
+// order is returned, not just the first pick, so failover can walk the rest.
+// Caller must hold stateMu.
+func (cb *CircuitBreaker) orderBackends(states []*BackendState, rrTick uint64) {
+	sort.SliceStable(states, func(i, j int) bool {
+		return states[i].backend.Priority < states[j].backend.Priority
+	})
+
+	for start := 0; start < len(states); {
+		end := start + 1
+		for end < len(states) && states[end].backend.Priority == states[start].backend.Priority {
+			end++
+		}
+		cb.orderGroup(states[start:end], rrTick)
+		start = end
+	}
+}
+
+// orderGroup orders backends that share a priority. Caller must hold stateMu.
+func (cb *CircuitBreaker) orderGroup(group []*BackendState, rrTick uint64) {
+	if len(group) < 2 {
+		return
+	}
+
+	switch cb.config.LoadBalancing.Strategy {
+	case StrategyRoundRobin:
+		offset := int(rrTick % uint64(len(group)))
+		rotated := append(append([]*BackendState{}, group[offset:]...), group[:offset]...)
+		copy(group, rotated)
+
+	case StrategyWeightedRandom:
+		// Efraimidis–Spirakis: sorting by u^(1/w) descending yields a weighted random permutation
+		keys := make(map[*BackendState]float64, len(group))
+		for _, state := range group {
+			keys[state] = math.Pow(rand.Float64(), 1/float64(backendWeight(state)))
+		}
+		sort.SliceStable(group, func(i, j int) bool {
+			return keys[group[i]] > keys[group[j]]
+		})
+
+	case StrategyLeastInFlight:
+		sort.SliceStable(group, func(i, j int) bool {
+			li := float64(group[i].inFlight.Load()) / float64(backendWeight(group[i]))
+			lj := float64(group[j].inFlight.Load()) / float64(backendWeight(group[j]))
+			return li < lj
+		})
+	}
+}
+
+func backendWeight(state *BackendState) int {
+	if state.backend.Weight <= 0 {
+		return 1
+	}
+	return state.backend.Weight
+}
+
+// AcquireInFlight marks the start of a request on a backend
+func (cb *CircuitBreaker) AcquireInFlight(state *BackendState) {
+	state.inFlight.Add(1)
+}
+
+// ReleaseInFlight marks the end of a request on a backend, including any streamed body
+func (cb *CircuitBreaker) ReleaseInFlight(state *BackendState) {
+	state.inFlight.Add(-1)
+}
+
+// InFlight returns the number of requests currently served by a backend
+func (cb *CircuitBreaker) InFlight(name string) int64 {
+	cb.stateMu.RLock()
+	defer cb.stateMu.RUnlock()
+
+	for _, state := range cb.states {
+		if state.backend.Name == name {
+			return state.inFlight.Load()
+		}
+	}
+	return 0
+}
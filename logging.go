@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// requestIDHeader carries the request ID back to the client and on to the upstream
+const requestIDHeader = "X-Request-Id"
+
+// logLevel is shared by the installed handler so a config reload can change it
+var logLevel = new(slog.LevelVar)
+
+type loggerContextKey struct{}
+
+// setupLogger installs the process-wide slog handler. The standard log package
+// is routed through it as well, so existing log.Printf lines share the format.
+func setupLogger(config *Config) {
+	level, _ := parseLogLevel(config.Logging.Level)
+	logLevel.Set(level)
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	if config.Logging.Format == "text" {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// parseLogLevel maps a config level name to a slog level
+func parseLogLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("未知的日志级别: %q", name)
+	}
+}
+
+// requestID returns the client's X-Request-Id if it is usable, otherwise a new random ID
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" && len(id) <= 128 && isPrintableASCII(id) {
+		return id
+	}
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "req_unknown"
+	}
+	return "req_" + hex.EncodeToString(b[:])
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x21 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestLogger stores a request-scoped logger in the request context
+func withRequestLogger(r *http.Request, logger *slog.Logger) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), loggerContextKey{}, logger))
+}
+
+// requestLogger returns the request-scoped logger, falling back to the default logger
+func requestLogger(r *http.Request) *slog.Logger {
+	if logger, ok := r.Context().Value(loggerContextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// upstreamAttempt identifies one upstream attempt in the logs
+type upstreamAttempt struct {
+	backend  string
+	model    string // Model sent upstream, after routing and backend overrides
+	stream   bool
+	attempt  int
+	halfOpen bool
+}
+
+// logUpstreamAttempt emits one record per upstream attempt. status is 0 when the
+// backend never produced an HTTP response; usage is only known for the attempt
+// that answered the client.
+func logUpstreamAttempt(logger *slog.Logger, a upstreamAttempt, status int, latency time.Duration, usage tokenUsage, err error) {
+	attrs := []any{"backend", a.backend, "model", a.model, "stream", a.stream, "attempt", a.attempt,
+		"status", status, "latency_ms", latency.Milliseconds(),
+		"input_tokens", usage.InputTokens, "output_tokens", usage.OutputTokens,
+		"cache_read_tokens", usage.CacheReadTokens, "cache_creation_tokens", usage.CacheCreationTokens}
+	if a.halfOpen {
+		attrs = append(attrs, "half_open", true)
+	}
+	if err != nil {
+		logger.Warn("[上游尝试]", append(attrs, "error", err.Error())...)
+		return
+	}
+	logger.Info("[上游尝试]", attrs...)
+}
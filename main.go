@@ -14,6 +14,7 @@ import (
 
 func main() {
 	configPath := flag.String("config", "config.json", "配置文件路径")
+	reloadInterval := flag.Duration("reload-interval", 5*time.Second, "配置文件变更检测间隔,0 表示仅通过 SIGHUP 重载")
 	flag.Parse()
 
 	server, err := NewProxyServer(*configPath)
@@ -21,10 +22,13 @@ func main() {
 		log.Fatalf("初始化失败: %v", err)
 	}
 
+	config := server.getConfig()
+	setupLogger(config)
+
 	log.Printf("Claude API 故障转移代理启动中...")
-	log.Printf("监听端口: %d", server.config.Port)
+	log.Printf("监听端口: %d", config.Port)
 	log.Printf("配置的后端:")
-	for i, backend := range server.config.Backends {
+	for i, backend := range config.Backends {
 		status := "禁用"
 		if backend.Enabled {
 			status = "启用"
@@ -33,19 +37,44 @@ func main() {
 		if backend.Model != "" {
 			modelInfo = fmt.Sprintf(" (模型覆盖: %s)", backend.Model)
 		}
-		log.Printf("  %d. %s - %s [%s]%s", i+1, backend.Name, backend.BaseURL, status, modelInfo)
+		log.Printf("  %d. %s - %s [%s]%s (优先级 %d, 权重 %d)", i+1, backend.Name, backend.BaseURL, status, modelInfo, backend.Priority, backend.Weight)
+	}
+	log.Printf("负载均衡策略: %s", config.LoadBalancing.Strategy)
+	log.Printf("日志: 级别 %s, 格式 %s", config.Logging.Level, config.Logging.Format)
+	log.Printf("最大尝试次数: %d (同一后端网络错误重试 %d 次)", config.Retry.MaxAttempts, config.Retry.SameBackendRetries)
+	log.Printf("请求超时: %d 秒", config.Retry.Timeout)
+	if config.Retry.RequestDeadline > 0 {
+		log.Printf("请求总时限: %d 秒", config.Retry.RequestDeadline)
 	}
-	log.Printf("最大重试次数: %d", server.config.Retry.MaxAttempts)
-	log.Printf("请求超时: %d 秒", server.config.Retry.Timeout)
 	log.Printf("熔断配置: 连续失败 %d 次触发,熔断 %d 秒",
-		server.config.Failover.CircuitBreaker.FailureThreshold,
-		server.config.Failover.CircuitBreaker.OpenTimeoutSeconds)
+		config.Failover.CircuitBreaker.FailureThreshold,
+		config.Failover.CircuitBreaker.OpenTimeoutSeconds)
 	log.Printf("限流配置: 429 错误后冷却 %d 秒",
-		server.config.Failover.RateLimit.CooldownSeconds)
+		config.Failover.RateLimit.CooldownSeconds)
+	if config.Metrics.Enabled {
+		log.Printf("监控指标: http://localhost:%d%s", config.Port, config.Metrics.Path)
+	}
+	if len(config.Auth.Keys) > 0 {
+		log.Printf("客户端认证: 已启用 (%d 个 key)", len(config.Auth.Keys))
+	} else {
+		log.Printf("客户端认证: 未启用 (未配置 auth.keys,任何能访问端口的客户端都可使用后端 token)")
+	}
+	if config.StateFile != "" {
+		log.Printf("状态持久化: %s", config.StateFile)
+	}
+	if config.Admin.Token != "" {
+		if config.Admin.Port > 0 {
+			log.Printf("管理接口: http://localhost:%d/admin/backends", config.Admin.Port)
+		} else {
+			log.Printf("管理接口: http://localhost:%d/admin/backends", config.Port)
+		}
+	} else {
+		log.Printf("管理接口: 未启用 (未配置 admin.token)")
+	}
 
-	addr := fmt.Sprintf(":%d", server.config.Port)
-	log.Printf("\n✓ 代理服务器运行在 http://localhost%s", addr)
-	log.Printf("✓ 配置 Claude Code: export ANTHROPIC_BASE_URL=http://localhost%s\n", addr)
+	addr := fmt.Sprintf(":%d", config.Port)
+	log.Printf("✓ 代理服务器运行在 http://localhost%s", addr)
+	log.Printf("✓ 配置 Claude Code: export ANTHROPIC_BASE_URL=http://localhost%s", addr)
 
 	// Create HTTP server with graceful shutdown
 	httpServer := &http.Server{
@@ -59,11 +88,43 @@ func main() {
 		}
 	}()
 
+	// Optional dedicated listener for the management API
+	var adminServer *http.Server
+	if config.Admin.Port > 0 {
+		adminServer = &http.Server{
+			Addr:    fmt.Sprintf(":%d", config.Admin.Port),
+			Handler: server.admin,
+		}
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("管理接口启动失败: %v", err)
+			}
+		}()
+	}
+
+	// Config hot reload: file watcher plus SIGHUP
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	if *reloadInterval > 0 {
+		go server.watchConfig(watchCtx, *reloadInterval)
+		log.Printf("✓ 配置热重载: 每 %s 检测 %s 变更,或发送 SIGHUP", *reloadInterval, *configPath)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Printf("[配置重载] 收到 SIGHUP")
+			server.Reload()
+		}
+	}()
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
+	stopWatch()
 
-	log.Println("\n收到关闭信号,正在优雅关闭服务器...")
+	log.Println("收到关闭信号,正在优雅关闭服务器...")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -71,6 +132,15 @@ func main() {
 	if err := httpServer.Shutdown(ctx); err != nil {
 		log.Printf("服务器强制关闭: %v", err)
 	}
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			log.Printf("管理接口强制关闭: %v", err)
+		}
+	}
+
+	if err := server.circuitBreaker.SaveState(); err != nil {
+		log.Printf("[状态持久化] 保存失败: %v", err)
+	}
 
 	log.Println("✓ 服务器已安全关闭")
 }
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics collects proxy metrics and renders them in the Prometheus text
+// exposition format. It is self-contained so the proxy keeps a single
+// dependency and the output can be checked with a plain HTTP request.
+type Metrics struct {
+	upstreamRequests *counterVec
+	upstreamLatency  *histogramVec
+	upstreamTTFB     *histogramVec
+	rateLimited      *counterVec
+	localThrottled   *counterVec
+	requests         *counterVec
+	failoverHops     *histogramVec
+	tokens           *counterVec
+}
+
+var (
+	latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+	ttfbBuckets    = []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 30, 60}
+	hopBuckets     = []float64{0, 1, 2, 3, 5, 8}
+)
+
+// NewMetrics creates an empty metrics registry
+func NewMetrics() *Metrics {
+	return &Metrics{
+		upstreamRequests: newCounterVec("ccproxy_upstream_requests_total",
+			"Upstream attempts by backend and response status class (error = no HTTP response).", "backend", "status_class"),
+		upstreamLatency: newHistogramVec("ccproxy_upstream_latency_seconds",
+			"Duration of an upstream attempt until the response was fully delivered or abandoned.", latencyBuckets, "backend"),
+		upstreamTTFB: newHistogramVec("ccproxy_upstream_ttfb_seconds",
+			"Time from sending the upstream request to receiving response headers.", ttfbBuckets, "backend"),
+		rateLimited: newCounterVec("ccproxy_rate_limit_cooldowns_total",
+			"429 responses that put a backend into rate limit cooldown.", "backend"),
+		localThrottled: newCounterVec("ccproxy_local_rate_limited_total",
+			"Requests that found a backend's local rpm/tpm budget exhausted, by whether they waited for it or moved on.", "backend", "result"),
+		requests: newCounterVec("ccproxy_requests_total",
+			"Client requests by outcome.", "outcome"),
+		failoverHops: newHistogramVec("ccproxy_failover_hops",
+			"Upstream attempts beyond the first per client request.", hopBuckets),
+		tokens: newCounterVec("ccproxy_tokens_total",
+			"Token usage reported in backend responses.", "backend", "type"),
+	}
+}
+
+// RecordUpstreamResponse counts an upstream attempt; statusCode 0 means no HTTP response
+func (m *Metrics) RecordUpstreamResponse(backend string, statusCode int, ttfb time.Duration) {
+	if statusCode == 0 {
+		m.upstreamRequests.Inc(backend, "error")
+		return
+	}
+	m.upstreamRequests.Inc(backend, fmt.Sprintf("%dxx", statusCode/100))
+	m.upstreamTTFB.Observe(ttfb.Seconds(), backend)
+}
+
+// ObserveUpstreamLatency records the total duration of an upstream attempt
+func (m *Metrics) ObserveUpstreamLatency(backend string, d time.Duration) {
+	m.upstreamLatency.Observe(d.Seconds(), backend)
+}
+
+// RecordRateLimited counts a 429 cooldown
+func (m *Metrics) RecordRateLimited(backend string) {
+	m.rateLimited.Inc(backend)
+}
+
+// RecordLocalThrottled counts a request held up by a backend's local rpm/tpm limit; result is queued or skipped
+func (m *Metrics) RecordLocalThrottled(backend, result string) {
+	m.localThrottled.Inc(backend, result)
+}
+
+// RecordRequest records the outcome of a client request and how many failover hops it took
+func (m *Metrics) RecordRequest(outcome string, attempts int) {
+	m.requests.Inc(outcome)
+	if attempts > 0 {
+		m.failoverHops.Observe(float64(attempts - 1))
+	}
+}
+
+// RecordTokens adds token usage for a backend
+func (m *Metrics) RecordTokens(backend string, usage tokenUsage) {
+	m.tokens.Add(float64(usage.InputTokens), backend, "input")
+	m.tokens.Add(float64(usage.OutputTokens), backend, "output")
+	m.tokens.Add(float64(usage.CacheReadTokens), backend, "cache_read")
+	m.tokens.Add(float64(usage.CacheCreationTokens), backend, "cache_creation")
+}
+
+// metricsHandler serves the metrics, adding backend state gauges read from the circuit breaker at scrape time
+func (ps *ProxyServer) metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		ps.metrics.writeTo(w)
+		ps.writeBackendGauges(w)
+	})
+}
+
+// writeBackendGauges renders circuit breaker, rate limit and in-flight state per backend
+func (ps *ProxyServer) writeBackendGauges(w io.Writer) {
+	backends := ps.circuitBreaker.ListBackends()
+
+	fmt.Fprintln(w, "# HELP ccproxy_backend_enabled Whether the backend is enabled (1) or disabled (0).")
+	fmt.Fprintln(w, "# TYPE ccproxy_backend_enabled gauge")
+	for _, backend := range backends {
+		fmt.Fprintf(w, "ccproxy_backend_enabled{backend=%s} %d\n", quoteLabel(backend.Name), boolToInt(backend.Enabled))
+	}
+
+	fmt.Fprintln(w, "# HELP ccproxy_circuit_breaker_state Circuit breaker state: 0 closed, 1 half-open, 2 open, 3 quarantined (out of credit/quota).")
+	fmt.Fprintln(w, "# TYPE ccproxy_circuit_breaker_state gauge")
+	for _, backend := range backends {
+		value := 0
+		switch ps.circuitBreaker.GetBackendState(backend.Name).State {
+		case "half-open":
+			value = 1
+		case "open":
+			value = 2
+		case "quarantined":
+			value = 3
+		}
+		fmt.Fprintf(w, "ccproxy_circuit_breaker_state{backend=%s} %d\n", quoteLabel(backend.Name), value)
+	}
+
+	fmt.Fprintln(w, "# HELP ccproxy_circuit_breaker_consecutive_failures Consecutive failures recorded by the circuit breaker.")
+	fmt.Fprintln(w, "# TYPE ccproxy_circuit_breaker_consecutive_failures gauge")
+	for _, backend := range backends {
+		fmt.Fprintf(w, "ccproxy_circuit_breaker_consecutive_failures{backend=%s} %d\n",
+			quoteLabel(backend.Name), ps.circuitBreaker.GetBackendState(backend.Name).ConsecutiveFailures)
+	}
+
+	fmt.Fprintln(w, "# HELP ccproxy_rate_limit_cooldown_seconds Remaining 429 cooldown in seconds (0 when not rate limited).")
+	fmt.Fprintln(w, "# TYPE ccproxy_rate_limit_cooldown_seconds gauge")
+	for _, backend := range backends {
+		fmt.Fprintf(w, "ccproxy_rate_limit_cooldown_seconds{backend=%s} %d\n",
+			quoteLabel(backend.Name), ps.circuitBreaker.GetRateLimitState(backend.Name).RetryAfter)
+	}
+
+	fmt.Fprintln(w, "# HELP ccproxy_rate_limit_nearly_exhausted Whether a reported rate limit of the backend is nearly exhausted (1), lowering its priority.")
+	fmt.Fprintln(w, "# TYPE ccproxy_rate_limit_nearly_exhausted gauge")
+	for _, backend := range backends {
+		fmt.Fprintf(w, "ccproxy_rate_limit_nearly_exhausted{backend=%s} %d\n",
+			quoteLabel(backend.Name), boolToInt(ps.circuitBreaker.GetRateLimitState(backend.Name).NearlyExhausted))
+	}
+
+	fmt.Fprintln(w, "# HELP ccproxy_rate_limit_remaining Remaining capacity last reported by the backend's rate limit headers.")
+	fmt.Fprintln(w, "# TYPE ccproxy_rate_limit_remaining gauge")
+	for _, backend := range backends {
+		limits := ps.circuitBreaker.GetRateLimitState(backend.Name).Limits
+		for _, name := range sortedKeys(limits) {
+			fmt.Fprintf(w, "ccproxy_rate_limit_remaining{backend=%s,limit=%s} %d\n",
+				quoteLabel(backend.Name), quoteLabel(name), limits[name].Remaining)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP ccproxy_backend_in_flight Requests currently being served by the backend.")
+	fmt.Fprintln(w, "# TYPE ccproxy_backend_in_flight gauge")
+	for _, backend := range backends {
+		fmt.Fprintf(w, "ccproxy_backend_in_flight{backend=%s} %d\n", quoteLabel(backend.Name), ps.circuitBreaker.InFlight(backend.Name))
+	}
+}
+
+func (m *Metrics) writeTo(w io.Writer) {
+	m.upstreamRequests.writeTo(w)
+	m.upstreamLatency.writeTo(w)
+	m.upstreamTTFB.writeTo(w)
+	m.rateLimited.writeTo(w)
+	m.localThrottled.writeTo(w)
+	m.requests.writeTo(w)
+	m.failoverHops.writeTo(w)
+	m.tokens.writeTo(w)
+}
+
+// counterVec is a counter partitioned by label values
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64 // Key: label values joined by "\xff"
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(labelValues, "\xff")] += v
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, "", ""), formatFloat(c.values[key]))
+	}
+}
+
+// histogramVec is a histogram partitioned by label values
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // Cumulative counts are computed on output
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+	for _, key := range sortedKeys(h.values) {
+		hist := h.values[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, "", ""), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), hist.count)
+	}
+}
+
+// formatLabels renders {name="value",...}, optionally appending an extra label such as le
+func formatLabels(names []string, key, extraName, extraValue string) string {
+	var pairs []string
+	if len(names) > 0 {
+		values := strings.Split(key, "\xff")
+		for i, name := range names {
+			value := ""
+			if i < len(values) {
+				value = values[i]
+			}
+			pairs = append(pairs, name+"="+quoteLabel(value))
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"="+quoteLabel(extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// quoteLabel escapes a label value per the exposition format
+func quoteLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	return `"` + v + `"`
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// assertLines fails for every expected exposition line missing from output
+func assertLines(t *testing.T, output string, want ...string) {
+	t.Helper()
+
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(output, "\n") {
+		lines[line] = true
+	}
+	for _, line := range want {
+		if !lines[line] {
+			t.Errorf("缺少指标行 %q\n输出:\n%s", line, output)
+		}
+	}
+}
+
+func TestMetricsWriteTo(t *testing.T) {
+	m := NewMetrics()
+	m.RecordUpstreamResponse("b1", 200, 300*time.Millisecond)
+	m.RecordUpstreamResponse("b1", 503, 0)
+	m.RecordUpstreamResponse("b2", 0, 0)
+	m.ObserveUpstreamLatency("b1", 1500*time.Millisecond)
+	m.RecordRateLimited("b1")
+	m.RecordLocalThrottled("b2", "queued")
+	m.RecordRequest("success", 1)
+	m.RecordRequest("success", 3)
+	m.RecordTokens("b1", tokenUsage{InputTokens: 120, OutputTokens: 30})
+	m.RecordRequest(`we"ird\outcome`, 0)
+
+	var out strings.Builder
+	m.writeTo(&out)
+	assertLines(t, out.String(),
+		"# TYPE ccproxy_upstream_requests_total counter",
+		`ccproxy_upstream_requests_total{backend="b1",status_class="2xx"} 1`,
+		`ccproxy_upstream_requests_total{backend="b1",status_class="5xx"} 1`,
+		`ccproxy_upstream_requests_total{backend="b2",status_class="error"} 1`,
+		"# TYPE ccproxy_upstream_latency_seconds histogram",
+		`ccproxy_upstream_latency_seconds_bucket{backend="b1",le="1"} 0`,
+		`ccproxy_upstream_latency_seconds_bucket{backend="b1",le="2.5"} 1`,
+		`ccproxy_upstream_latency_seconds_bucket{backend="b1",le="+Inf"} 1`,
+		`ccproxy_upstream_latency_seconds_sum{backend="b1"} 1.5`,
+		`ccproxy_upstream_latency_seconds_count{backend="b1"} 1`,
+		`ccproxy_rate_limit_cooldowns_total{backend="b1"} 1`,
+		`ccproxy_local_rate_limited_total{backend="b2",result="queued"} 1`,
+		`ccproxy_requests_total{outcome="success"} 2`,
+		`ccproxy_requests_total{outcome="we\"ird\\outcome"} 1`,
+		`ccproxy_failover_hops_bucket{le="0"} 1`,
+		`ccproxy_failover_hops_bucket{le="2"} 2`,
+		`ccproxy_failover_hops_count 2`,
+		`ccproxy_tokens_total{backend="b1",type="input"} 120`,
+		`ccproxy_tokens_total{backend="b1",type="output"} 30`,
+	)
+}
+
+func TestWriteBackendGauges(t *testing.T) {
+	config := &Config{}
+	config.Backends = []Backend{
+		{Name: "open", Enabled: true},
+		{Name: "limited", Enabled: true},
+		{Name: "off", Enabled: false},
+		{Name: "broke", Enabled: true},
+	}
+	config.Failover.CircuitBreaker.OpenTimeoutSeconds = 60
+	config.Failover.RateLimit.CooldownSeconds = 30
+	ps := &ProxyServer{circuitBreaker: NewCircuitBreaker(config)}
+	ps.circuitBreaker.TripBackend("open")
+	ps.circuitBreaker.Record429(ps.circuitBreaker.states[1], nil)
+	ps.circuitBreaker.Quarantine(ps.circuitBreaker.states[3], time.Hour, "HTTP 402 配额耗尽")
+
+	var out strings.Builder
+	ps.writeBackendGauges(&out)
+	assertLines(t, out.String(),
+		"# TYPE ccproxy_backend_enabled gauge",
+		`ccproxy_backend_enabled{backend="open"} 1`,
+		`ccproxy_backend_enabled{backend="off"} 0`,
+		`ccproxy_circuit_breaker_state{backend="open"} 2`,
+		`ccproxy_circuit_breaker_state{backend="limited"} 0`,
+		`ccproxy_circuit_breaker_state{backend="broke"} 3`,
+		`ccproxy_rate_limit_cooldown_seconds{backend="limited"} 30`,
+		`ccproxy_rate_limit_cooldown_seconds{backend="open"} 0`,
+		`ccproxy_backend_in_flight{backend="open"} 0`,
+	)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// persistDelay batches state changes into one write of the state file
+const persistDelay = time.Second
+
+// persistedState is the content of the state file
+type persistedState struct {
+	SavedAt  time.Time                        `json:"saved_at"`
+	Backends map[string]persistedBackendState `json:"backends"` // Keyed by backend name
+}
+
+// persistedBackendState is the part of BackendState that survives a restart
+type persistedBackendState struct {
+	Enabled             *bool     `json:"enabled,omitempty"` // Only set when changed via the management API
+	CircuitOpen         bool      `json:"circuit_open,omitempty"`
+	OpenedAt            time.Time `json:"opened_at,omitzero"`
+	OpenForSeconds      int64     `json:"open_for_seconds,omitempty"` // Unset = open_timeout_seconds
+	Quarantined         bool      `json:"quarantined,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures,omitempty"`
+	LastError           string    `json:"last_error,omitempty"`
+	CooldownUntil       time.Time `json:"cooldown_until,omitzero"`
+}
+
+// persist schedules a write of the state file. It never blocks, so it may be
+// called with stateMu held.
+func (cb *CircuitBreaker) persist() {
+	select {
+	case cb.persistCh <- struct{}{}:
+	default:
+	}
+}
+
+// persistLoop writes the state file after changes, batching bursts
+func (cb *CircuitBreaker) persistLoop() {
+	for range cb.persistCh {
+		time.Sleep(persistDelay)
+		if err := cb.SaveState(); err != nil {
+			log.Printf("[状态持久化] 保存失败: %v", err)
+		}
+	}
+}
+
+// SaveState writes breaker state, 429 cooldowns and runtime enable/disable
+// overrides to the configured state file. The file is replaced atomically so a
+// crash never leaves a truncated file behind.
+func (cb *CircuitBreaker) SaveState() error {
+	cb.saveMu.Lock()
+	defer cb.saveMu.Unlock()
+
+	cb.stateMu.RLock()
+	path := cb.config.StateFile
+	snapshot := persistedState{SavedAt: time.Now(), Backends: make(map[string]persistedBackendState, len(cb.states))}
+	for _, state := range cb.states {
+		snapshot.Backends[state.backend.Name] = state.persisted()
+	}
+	cb.stateMu.RUnlock()
+
+	if path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// persisted captures the state worth restoring. Caller must hold stateMu.
+func (state *BackendState) persisted() persistedBackendState {
+	p := persistedBackendState{
+		CircuitOpen:         state.circuitOpen,
+		Quarantined:         state.quarantined,
+		ConsecutiveFailures: state.consecutiveFails,
+		LastError:           state.lastError,
+	}
+	if state.enabledOverride {
+		enabled := state.backend.Enabled
+		p.Enabled = &enabled
+	}
+	if state.circuitOpen {
+		p.OpenedAt = state.lastFailTime
+		p.OpenForSeconds = int64(state.openFor / time.Second)
+	}
+	if time.Now().Before(state.cooldownUntil) {
+		p.CooldownUntil = state.cooldownUntil
+	}
+	return p
+}
+
+// restore applies a saved state. Deadlines are absolute, so time spent while
+// the proxy was down counts towards them. An enable/disable override is then
+// kept across reloads exactly like one made at runtime. Caller must hold stateMu.
+func (state *BackendState) restore(p persistedBackendState) {
+	if p.Enabled != nil {
+		// The file may have been changed to the same value while the proxy was down
+		state.backend.Enabled = *p.Enabled
+		state.enabledOverride = *p.Enabled != state.fileEnabled
+	}
+	state.consecutiveFails = p.ConsecutiveFailures
+	state.lastError = p.LastError
+	if p.CircuitOpen {
+		state.circuitOpen = true
+		state.lastFailTime = p.OpenedAt
+		state.openFor = time.Duration(p.OpenForSeconds) * time.Second
+		state.quarantined = p.Quarantined
+	}
+	state.cooldownUntil = p.CooldownUntil
+}
+
+// loadState restores backend states from the state file. A missing file is
+// normal on first start; a broken one is logged and ignored so the proxy still
+// starts. Backends are matched by name, unknown names are dropped.
+func (cb *CircuitBreaker) loadState() {
+	path := cb.config.StateFile
+	if path == "" {
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	var saved persistedState
+	if err == nil {
+		err = json.Unmarshal(data, &saved)
+	}
+	if err != nil {
+		log.Printf("[状态持久化] 读取 %s 失败,忽略已保存的状态: %v", path, err)
+		return
+	}
+
+	cb.stateMu.Lock()
+	defer cb.stateMu.Unlock()
+
+	restored := 0
+	for _, state := range cb.states {
+		if p, ok := saved.Backends[state.backend.Name]; ok {
+			state.restore(p)
+			restored++
+		}
+	}
+	log.Printf("[状态持久化] 已从 %s 恢复 %d 个后端的状态 (保存于 %s)", path, restored, saved.SavedAt.Format(time.RFC3339))
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it into place
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op after a successful rename
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("替换状态文件失败: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testPersistConfig(path string, dEnabled bool) *Config {
+	config := &Config{StateFile: path}
+	config.Backends = []Backend{
+		{Name: "a", Enabled: true},
+		{Name: "b", Enabled: true},
+		{Name: "c", Enabled: true},
+		{Name: "d", Enabled: dEnabled},
+	}
+	config.Failover.CircuitBreaker.OpenTimeoutSeconds = 60
+	config.Failover.RateLimit.CooldownSeconds = 60
+	return config
+}
+
+func TestSaveStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	cb := NewCircuitBreaker(testPersistConfig(path, true))
+	cb.TripBackend("a")
+	cb.Record429(cb.states[1], nil)
+	cb.Quarantine(cb.states[2], 0, "credit balance is too low")
+	cb.OnBackendDisabled("d")
+	cooldownUntil := cb.states[1].cooldownUntil
+	if err := cb.SaveState(); err != nil {
+		t.Fatalf("保存失败: %v", err)
+	}
+
+	restored := NewCircuitBreaker(testPersistConfig(path, true))
+	if got := restored.GetBackendState("a").State; got != "open" {
+		t.Errorf("a: state = %s, want open", got)
+	}
+	if got := restored.states[1].cooldownUntil; !got.Equal(cooldownUntil) {
+		t.Errorf("b: cooldown_until = %v, want %v", got, cooldownUntil)
+	}
+	if state := restored.states[2]; !state.quarantined || state.openFor != quarantineForever {
+		t.Errorf("c: 未恢复为永久隔离 (quarantined=%v open_for=%v)", state.quarantined, state.openFor)
+	}
+	if restored.ListBackends()[3].Enabled {
+		t.Error("d: 运行时禁用未恢复")
+	}
+
+	// The restored override behaves like a runtime one on reload
+	restored.Reload(testPersistConfig(path, true))
+	if restored.ListBackends()[3].Enabled {
+		t.Error("d: 恢复的运行时禁用在重载后丢失")
+	}
+}
+
+func TestLoadStateOverrideMatchingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	cb := NewCircuitBreaker(testPersistConfig(path, true))
+	cb.OnBackendDisabled("d")
+	if err := cb.SaveState(); err != nil {
+		t.Fatalf("保存失败: %v", err)
+	}
+
+	// The file was changed to disable d while the proxy was down, so the
+	// override is redundant and a later edit of the file applies directly
+	restored := NewCircuitBreaker(testPersistConfig(path, false))
+	if restored.ListBackends()[3].Enabled {
+		t.Fatal("d: 应保持禁用")
+	}
+	if restored.states[3].enabledOverride {
+		t.Error("d: 与配置文件一致的覆盖未清除")
+	}
+}
+
+func TestLoadStateIgnoresExpiredCooldownAndMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	cb := NewCircuitBreaker(testPersistConfig(path, true))
+	if got := cb.GetBackendState("a").State; got != "closed" {
+		t.Fatalf("无状态文件时 state = %s, want closed", got)
+	}
+
+	cb.states[1].cooldownUntil = time.Now().Add(-time.Second)
+	if err := cb.SaveState(); err != nil {
+		t.Fatalf("保存失败: %v", err)
+	}
+	restored := NewCircuitBreaker(testPersistConfig(path, true))
+	if !restored.states[1].cooldownUntil.IsZero() {
+		t.Errorf("已过期的冷却被恢复: %v", restored.states[1].cooldownUntil)
+	}
+}
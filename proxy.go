@@ -3,16 +3,20 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/klauspost/compress/zstd"
@@ -27,6 +31,32 @@ type openaiChatCompletionRequest struct {
 	Stream      bool   `json:"stream,omitempty"`
 	Tools       []any  `json:"tools,omitempty"`
 	ToolChoice  any    `json:"tool_choice,omitempty"`
+
+	StreamOptions *openaiStreamOptions `json:"stream_options,omitempty"`
+}
+
+type openaiStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type openaiUsage struct {
+	PromptTokens        int `json:"prompt_tokens"`
+	CompletionTokens    int `json:"completion_tokens"`
+	PromptTokensDetails *struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details,omitempty"`
+}
+
+// anthropicUsage maps OpenAI usage to Anthropic's fields. OpenAI counts cached
+// tokens inside prompt_tokens, Anthropic reports them separately.
+func (u *openaiUsage) anthropicUsage() (inputTokens, outputTokens, cacheRead int) {
+	if u == nil {
+		return 0, 0, 0
+	}
+	if u.PromptTokensDetails != nil {
+		cacheRead = u.PromptTokensDetails.CachedTokens
+	}
+	return u.PromptTokens - cacheRead, u.CompletionTokens, cacheRead
 }
 
 type openaiChatCompletionResponse struct {
@@ -47,13 +77,33 @@ type openaiChatCompletionResponse struct {
 		} `json:"message"`
 		FinishReason string `json:"finish_reason"`
 	} `json:"choices"`
-	Usage *struct {
-		PromptTokens        int `json:"prompt_tokens"`
-		CompletionTokens    int `json:"completion_tokens"`
-		PromptTokensDetails *struct {
-			CachedTokens int `json:"cached_tokens"`
-		} `json:"prompt_tokens_details,omitempty"`
-	} `json:"usage,omitempty"`
+	Usage *openaiUsage `json:"usage,omitempty"`
+}
+
+type openaiChatCompletionChunk struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Delta struct {
+			Content   *string               `json:"content,omitempty"`
+			ToolCalls []openaiToolCallDelta `json:"tool_calls,omitempty"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason,omitempty"`
+	} `json:"choices"`
+	// Usage is only set on the final chunk when stream_options.include_usage is requested
+	Usage *openaiUsage `json:"usage,omitempty"`
+}
+
+// openaiToolCallDelta is a fragment of a streamed tool call. Index identifies
+// the call; id and name usually arrive once, arguments arrive in pieces.
+type openaiToolCallDelta struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments,omitempty"`
+	} `json:"function"`
 }
 
 type anthropicMessageRequest struct {
@@ -106,9 +156,16 @@ type anthropicImageSource struct {
 
 // ProxyServer is the proxy server
 type ProxyServer struct {
+	configPath     string
 	config         *Config
-	client         *http.Client
+	configMu       sync.RWMutex
+	reloadMu       sync.Mutex                // Serializes reloads so per-backend clients are rebuilt from the latest set
+	client         *http.Client              // Fallback for backends without a client of their own
+	clients        map[string]*backendClient // Per-backend clients, replaced together with config
 	circuitBreaker *CircuitBreaker
+	admin          http.Handler
+	metrics        *Metrics
+	clientLimiter  *clientLimiter
 }
 
 // NewProxyServer creates proxy server instance
@@ -118,21 +175,79 @@ func NewProxyServer(configPath string) (*ProxyServer, error) {
 		return nil, err
 	}
 
+	clients, err := buildBackendClients(config, nil)
+	if err != nil {
+		return nil, err
+	}
+
 	server := &ProxyServer{
-		config:         config,
+		configPath: configPath,
+		config:     config,
+		clients:    clients,
 		client: &http.Client{
 			// Don't set Timeout here - it would kill streaming responses
 			// We'll use context with timeout for non-streaming requests only
 			Timeout: 0,
 		},
 		circuitBreaker: NewCircuitBreaker(config),
+		metrics:        NewMetrics(),
+		clientLimiter:  newClientLimiter(),
 	}
+	server.admin = newAdminHandler(server)
 
 	return server, nil
 }
 
+// getConfig returns the current configuration snapshot.
+// The returned Config must not be modified; a reload replaces it as a whole.
+func (ps *ProxyServer) getConfig() *Config {
+	ps.configMu.RLock()
+	defer ps.configMu.RUnlock()
+	return ps.config
+}
+
+// snapshot returns the current configuration together with the backend
+// clients built for it. A request uses one snapshot from start to finish.
+func (ps *ProxyServer) snapshot() (*Config, map[string]*backendClient) {
+	ps.configMu.RLock()
+	defer ps.configMu.RUnlock()
+	return ps.config, ps.clients
+}
+
 // ServeHTTP handles HTTP requests
 func (ps *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	config, clients := ps.snapshot()
+
+	// Management API on the proxy port is never forwarded upstream
+	if config.Admin.Token != "" && config.Admin.Port == 0 && isAdminPath(r.URL.Path) {
+		ps.admin.ServeHTTP(w, r)
+		return
+	}
+
+	// Metrics are scraped without client credentials and never forwarded upstream
+	if config.Metrics.Enabled && r.URL.Path == config.Metrics.Path {
+		ps.metricsHandler().ServeHTTP(w, r)
+		return
+	}
+
+	reqID := requestID(r)
+	w.Header().Set(requestIDHeader, reqID)
+	logger := slog.Default().With("request_id", reqID)
+
+	client, ok := authenticateClient(r, config.Auth.Keys)
+	if !ok {
+		logger.Warn("[认证失败]", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+		writeAnthropicError(w, http.StatusUnauthorized, "authentication_error", "invalid x-api-key")
+		return
+	}
+	r = withClientName(r, client)
+	if client != "" {
+		logger = logger.With("client", client)
+	}
+	r = withRequestLogger(r, logger)
+	// Forwarded upstream so backend logs can be correlated with ours
+	r.Header.Set(requestIDHeader, reqID)
+
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Failed to read request body", http.StatusBadRequest)
@@ -140,86 +255,253 @@ func (ps *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	r.Body.Close()
 
-	backendCount := len(ps.config.Backends)
-	log.Printf("[请求开始] %s %s - 配置了 %d 个后端", r.Method, r.URL.Path, backendCount)
+	start := time.Now()
+	model := extractRequestModel(bodyBytes)
+	stream := isStreamingBody(bodyBytes)
+	logger.Debug("[请求开始]", "method", r.Method, "path", r.URL.Path, "model", model, "stream", stream, "backends", len(config.Backends))
 
-	var lastErr error
+	var failures []error // One per failed upstream attempt
 	attemptCount := 0
 	skippedCount := 0
 
-	// Get backends sorted by priority (non-rate-limited first)
-	sortedStates := ps.circuitBreaker.SortBackendsByPriority()
+	// One record per completed request, whichever way it ends
+	outcome := "all_failed"
+	finalStatus := 0
+	finalBackend := ""
+	var usage tokenUsage
+	defer func() {
+		ps.metrics.RecordRequest(outcome, attemptCount)
+		level := slog.LevelInfo
+		if outcome != "success" && outcome != "client_error" {
+			level = slog.LevelWarn
+		}
+		logger.Log(r.Context(), level, "[请求完成]",
+			"method", r.Method, "path", r.URL.Path, "model", model, "stream", stream,
+			"outcome", outcome, "status", finalStatus, "backend", finalBackend,
+			"attempts", attemptCount, "skipped", skippedCount, "latency_ms", time.Since(start).Milliseconds(),
+			"input_tokens", usage.InputTokens, "output_tokens", usage.OutputTokens,
+			"cache_read_tokens", usage.CacheReadTokens, "cache_creation_tokens", usage.CacheCreationTokens)
+	}()
 
-	for _, state := range sortedStates {
-		// Check if backend should be skipped
-		if skip, reason := ps.circuitBreaker.ShouldSkipBackend(state); skip {
-			skippedCount++
-			log.Printf("[跳过] %s - %s", state.backend.Name, reason)
-			continue
+	// Per-client limits protect the shared backends from a single runaway client
+	release, limitErr := ps.clientLimiter.acquire(clientLimitKey(r), limitsFor(config, client), stream)
+	if limitErr != nil {
+		outcome = "client_rate_limited"
+		finalStatus = http.StatusTooManyRequests
+		logger.Warn("[客户端限流]", "limit_key", clientLimitKey(r), "error", limitErr.message)
+		writeClientLimitError(w, limitErr)
+		return
+	}
+	defer release()
+
+	// max_attempts caps upstream attempts, including same-backend retries;
+	// the optional deadline bounds the whole failover cascade.
+	maxAttempts := config.Retry.MaxAttempts
+	var deadline time.Time
+	if config.Retry.RequestDeadline > 0 {
+		deadline = time.Now().Add(time.Duration(config.Retry.RequestDeadline) * time.Second)
+	}
+	backoffInitial := time.Duration(config.Retry.BackoffInitialMs) * time.Millisecond
+	backoffMax := time.Duration(config.Retry.BackoffMaxMs) * time.Millisecond
+
+	// Routing rules may narrow the backend list and rewrite the model
+	var routeBackends []string
+	upstreamModel := model
+	if route := matchRoute(config.Routes, r, model); route != nil {
+		if len(route.Backends) > 0 {
+			routeBackends = route.Backends
+		}
+		logger.Debug("[路由]", "route", route.Name, "backends", route.Backends)
+		if route.RewriteModel != "" {
+			if modifiedBody, ok := setRequestModel(bodyBytes, route.RewriteModel); ok {
+				bodyBytes = modifiedBody
+				upstreamModel = route.RewriteModel
+				logger.Debug("[路由] 模型改写", "route", route.Name, "model", route.RewriteModel)
+			}
 		}
+	}
 
-		attemptCount++
+	queueUntil := time.Now().Add(time.Duration(config.Failover.RateLimit.QueueTimeoutMs) * time.Millisecond)
 
-		targetURL := state.backend.BaseURL + r.URL.Path
-		if r.URL.RawQuery != "" {
-			targetURL += "?" + r.URL.RawQuery
-		}
+	// Get backends sorted by priority (non-rate-limited first)
+	sortedStates := ps.circuitBreaker.SortBackendsByPriority(routeBackends)
 
-		tokenPreview := state.backend.Token
-		if len(tokenPreview) > 12 {
-			tokenPreview = tokenPreview[:4] + "..." + tokenPreview[len(tokenPreview)-4:]
+backends:
+	for _, state := range sortedStates {
+		if attemptCount >= maxAttempts {
+			logger.Warn("[尝试上限] 停止故障转移", "max_attempts", maxAttempts)
+			break
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			logger.Warn("[请求超时] 已超过请求总时限,停止故障转移", "deadline_seconds", config.Retry.RequestDeadline)
+			break
+		}
+		if r.Context().Err() != nil {
+			logger.Info("[客户端断开] 停止故障转移")
+			outcome = "canceled"
+			return
 		}
 
-		// Check if this is a half-open test request
-		isHalfOpen := ps.circuitBreaker.IsHalfOpen(state)
-		if isHalfOpen {
-			ps.circuitBreaker.IncrementHalfOpenTries(state)
-			log.Printf("[尝试 #%d] %s - %s %s (token: %s) [熔断测试 %d/%d]",
-				attemptCount, state.backend.Name, r.Method, targetURL, tokenPreview,
-				state.halfOpenTries, ps.config.Failover.CircuitBreaker.HalfOpenRequests)
-		} else {
-			log.Printf("[尝试 #%d] %s - %s %s (token: %s)", attemptCount, state.backend.Name, r.Method, targetURL, tokenPreview)
+		// Settings come from this request's snapshot; enabled, breaker and
+		// cooldown state are live
+		backend, ok := config.backend(ps.circuitBreaker.Backend(state).Name)
+		if !ok {
+			continue // Added by a reload after the request started
 		}
 
-		resp, shouldRetry, err := ps.forwardRequest(state, r, bodyBytes)
-		if err != nil {
-			lastErr = err
-			log.Printf("[失败 #%d] %s - %s - %v", attemptCount, state.backend.Name, targetURL, err)
+		// Check if backend should be skipped
+		if skip, reason := ps.circuitBreaker.ShouldSkipBackend(state); skip {
+			skippedCount++
+			logger.Debug("[跳过]", "backend", backend.Name, "reason", reason)
 			continue
 		}
 
-		// Check if we should retry with next backend
-		if shouldRetry {
-			lastErr = fmt.Errorf("HTTP %d", resp.StatusCode)
-			resp.Body.Close()
+		// Local rpm/tpm limits: wait for budget within the queue time, otherwise move on
+		if ok, waited := ps.waitLocalLimit(r.Context(), state, queueUntil, deadline); !ok {
+			skippedCount++
+			ps.metrics.RecordLocalThrottled(backend.Name, "skipped")
+			logger.Debug("[跳过]", "backend", backend.Name, "reason", "本地 rpm/tpm 限额已用尽")
 			continue
+		} else if waited > 0 {
+			ps.metrics.RecordLocalThrottled(backend.Name, "queued")
+			logger.Info("[本地限流] 等待限额后继续", "backend", backend.Name, "waited_ms", waited.Milliseconds())
 		}
 
-		// Response will be returned to client (2xx success or 4xx client error)
-		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-			log.Printf("[成功 #%d] %s - %s - HTTP %d", attemptCount, state.backend.Name, targetURL, resp.StatusCode)
-		} else {
-			log.Printf("[返回客户端] %d - %s - HTTP %s - %s (客户端错误,不重试)", attemptCount, state.backend.Name, targetURL, resp.Status)
+		for retry := 0; ; retry++ {
+			attemptCount++
+
+			// Check if this is a half-open test request
+			isHalfOpen := ps.circuitBreaker.IsHalfOpen(state)
+			if isHalfOpen {
+				ps.circuitBreaker.IncrementHalfOpenTries(state)
+			}
+
+			attempt := upstreamAttempt{backend: backend.Name, model: cmp.Or(backend.Model, upstreamModel),
+				stream: stream, attempt: attemptCount, halfOpen: isHalfOpen}
+			attemptStart := time.Now()
+			ps.circuitBreaker.AcquireInFlight(state)
+			resp, shouldRetry, err := ps.forwardRequest(config, ps.clientFor(clients, backend.Name), state, backend, r, bodyBytes, deadline)
+			if err != nil {
+				ps.circuitBreaker.ReleaseInFlight(state)
+				ps.metrics.ObserveUpstreamLatency(backend.Name, time.Since(attemptStart))
+				failures = append(failures, err)
+				logUpstreamAttempt(logger, attempt, errorStatusCode(err), time.Since(attemptStart), tokenUsage{}, err)
+
+				// Transient network errors get a few retries on the same backend before moving on
+				if retry >= config.Retry.SameBackendRetries || !isTransientNetworkError(err) || attemptCount >= maxAttempts {
+					continue backends
+				}
+				if skip, _ := ps.circuitBreaker.ShouldSkipBackend(state); skip {
+					continue backends
+				}
+				delay := backoffDelay(retry, backoffInitial, backoffMax)
+				logger.Info("[同后端重试]", "backend", backend.Name, "delay_ms", delay.Milliseconds(),
+					"retry", retry+1, "same_backend_retries", config.Retry.SameBackendRetries)
+				if !sleepUntil(r.Context(), delay, deadline) {
+					continue backends
+				}
+				continue
+			}
+
+			// Check if we should retry with next backend
+			if shouldRetry {
+				ps.circuitBreaker.ReleaseInFlight(state)
+				ps.metrics.ObserveUpstreamLatency(backend.Name, time.Since(attemptStart))
+				statusErr := &upstreamStatusError{statusCode: resp.StatusCode}
+				failures = append(failures, statusErr)
+				logUpstreamAttempt(logger, attempt, resp.StatusCode, time.Since(attemptStart), tokenUsage{}, statusErr)
+				resp.Body.Close()
+				continue backends
+			}
+
+			// Streams are held back until the first content event, so an upstream
+			// that fails before producing anything can still fail over. Past the
+			// request deadline there is nothing left to fail over to.
+			var sse *sseStream
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 && isEventStream(resp) {
+				sse = newSSEStream(resp.Body)
+				if err := sse.awaitContent(r.Context(), config.Streaming.FailoverBufferBytes,
+					capToDeadline(time.Duration(config.Streaming.FailoverBufferMs)*time.Millisecond, deadline)); err != nil {
+					resp.Body.Close()
+					if errors.Is(err, errClientGone) {
+						ps.circuitBreaker.ReleaseInFlight(state)
+						logger.Info("[客户端断开] 停止故障转移")
+						outcome = "canceled"
+						return
+					}
+					ps.recordStreamResult(state, backend.Name, err)
+					ps.circuitBreaker.ReleaseInFlight(state)
+					ps.metrics.ObserveUpstreamLatency(backend.Name, time.Since(attemptStart))
+					failures = append(failures, err)
+					logUpstreamAttempt(logger, attempt, resp.StatusCode, time.Since(attemptStart), sse.usage, err)
+					continue backends
+				}
+			}
+
+			// Response will be returned to client (2xx success or 4xx client error)
+			outcome = "success"
+			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+				outcome = "client_error"
+			}
+			finalStatus = resp.StatusCode
+			finalBackend = backend.Name
+
+			var streamErr error
+			if sse != nil {
+				usage, streamErr = ps.relayStream(r.Context(), w, resp, sse, logger)
+			} else {
+				usage = ps.copyResponse(w, resp, logger)
+			}
+			if sse != nil {
+				// Too late to fail over: the client already has part of the response
+				if errors.Is(streamErr, errClientGone) {
+					outcome = "canceled"
+				} else if ps.recordStreamResult(state, backend.Name, streamErr) {
+					outcome = "stream_error"
+				} else if streamErr != nil {
+					outcome = "client_error"
+				}
+			}
+			ps.circuitBreaker.ReleaseInFlight(state)
+			ps.metrics.ObserveUpstreamLatency(backend.Name, time.Since(attemptStart))
+			ps.metrics.RecordTokens(backend.Name, usage)
+			ps.circuitBreaker.ChargeTokens(state, usage)
+			logUpstreamAttempt(logger, attempt, resp.StatusCode, time.Since(attemptStart), usage, streamErr)
+			return
 		}
+	}
 
-		ps.copyResponse(w, resp)
+	// Every backend rejected the request itself: pass on the last rejection
+	if resp := rejectedResponse(failures); resp != nil {
+		outcome = "client_error"
+		finalStatus = resp.StatusCode
+		ps.copyResponse(w, resp, logger)
 		return
 	}
 
-	log.Printf("[全部失败] 所有后端不可用 (尝试 %d 个,跳过 %d 个)", attemptCount, skippedCount)
-	errMsg := "所有 API 后端不可用"
-	if lastErr != nil {
-		errMsg = fmt.Sprintf("%s: %v", errMsg, lastErr)
+	// Answer in the Anthropic error format so Claude Code and the SDKs apply
+	// their own retry logic, with a hint of when a backend is usable again
+	deadlineExceeded := !deadline.IsZero() && !time.Now().Before(deadline)
+	status, errType := allFailedError(failures, deadlineExceeded)
+	finalStatus = status
+	message := "no backend available"
+	if len(failures) > 0 {
+		message = fmt.Sprintf("all backends failed after %d attempts, last error: %v", len(failures), failures[len(failures)-1])
 	}
-	http.Error(w, errMsg, http.StatusBadGateway)
+	if wait, ok := ps.circuitBreaker.NextAvailable(routeBackends); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+	writeAnthropicError(w, status, errType, message)
 }
 
 // forwardRequest forwards request to specified backend
 // Returns: (response, shouldRetry, error)
-// - shouldRetry=true: should try next backend (5xx, 429, timeout)
-// - shouldRetry=false: return response to client (2xx, 3xx, 4xx except 429)
-func (ps *ProxyServer) forwardRequest(state *BackendState, originalReq *http.Request, bodyBytes []byte) (*http.Response, bool, error) {
-	backend := state.backend
+// - shouldRetry=true: should try next backend (5xx, 429, timeout, quota, failover rule)
+// - shouldRetry=false: return response to client (2xx, 3xx, other 4xx)
+// config and client are the request's snapshot. A non-zero deadline caps the
+// timeout of non-streaming requests and the first-byte timeout of streaming ones.
+func (ps *ProxyServer) forwardRequest(config *Config, client *http.Client, state *BackendState, backend Backend, originalReq *http.Request, bodyBytes []byte, deadline time.Time) (*http.Response, bool, error) {
+	logger := requestLogger(originalReq).With("backend", backend.Name)
 	targetURL, err := url.Parse(backend.BaseURL)
 	if err != nil {
 		ps.circuitBreaker.RecordFailure(state, 0)
@@ -227,10 +509,7 @@ func (ps *ProxyServer) forwardRequest(state *BackendState, originalReq *http.Req
 	}
 
 	// Determine platform type
-	platform := backend.Platform
-	if platform == "" {
-		platform = "anthropic" // Default to anthropic
-	}
+	platform := backend.PlatformType()
 
 	// Build target URL path - append client path to base URL path
 	targetURL.Path = targetURL.Path + originalReq.URL.Path
@@ -244,19 +523,18 @@ func (ps *ProxyServer) forwardRequest(state *BackendState, originalReq *http.Req
 		if strings.HasSuffix(originalReq.URL.Path, "/v1/messages") {
 			// Replace the path with OpenAI's chat completions endpoint
 			targetURL.Path = strings.TrimSuffix(targetURL.Path, "/v1/messages") + "/v1/chat/completions"
-			log.Printf("[路径转发] %s - /v1/messages → /v1/chat/completions", backend.Name)
+			logger.Debug("[路径转发] /v1/messages → /v1/chat/completions")
 		}
 	}
 
+	// Remember the model the client asked for before any override is applied
+	requestedModel := extractRequestModel(bodyBytes)
+
 	// Apply model override if specified
-	if backend.Model != "" && len(bodyBytes) > 0 {
-		var bodyMap map[string]any
-		if err := json.Unmarshal(bodyBytes, &bodyMap); err == nil {
-			bodyMap["model"] = backend.Model
-			if modifiedBody, err := json.Marshal(bodyMap); err == nil {
-				bodyBytes = modifiedBody
-				log.Printf("[模型覆盖] %s - 使用配置的模型: %s", backend.Name, backend.Model)
-			}
+	if backend.Model != "" {
+		if modifiedBody, ok := setRequestModel(bodyBytes, backend.Model); ok {
+			bodyBytes = modifiedBody
+			logger.Debug("[模型覆盖]", "model", backend.Model)
 		}
 	}
 
@@ -264,11 +542,11 @@ func (ps *ProxyServer) forwardRequest(state *BackendState, originalReq *http.Req
 	if platform == "openai" {
 		convertedBody, err := ps.convertAnthropicToOpenAI(bodyBytes)
 		if err != nil {
-			log.Printf("[格式转换失败] %s - %v", backend.Name, err)
+			logger.Warn("[格式转换失败]", "error", err)
 			// Continue with original body if conversion fails
 		} else {
 			bodyBytes = convertedBody
-			log.Printf("[格式转换] %s - Anthropic 格式已转换为 OpenAI 格式", backend.Name)
+			logger.Debug("[格式转换] Anthropic 格式已转换为 OpenAI 格式")
 		}
 	}
 
@@ -278,24 +556,36 @@ func (ps *ProxyServer) forwardRequest(state *BackendState, originalReq *http.Req
 		return nil, true, err
 	}
 
-	// Check if this is a streaming request
-	isStreamingRequest := false
-	if len(bodyBytes) > 0 {
-		var bodyMap map[string]any
-		if json.Unmarshal(bodyBytes, &bodyMap) == nil {
-			if stream, ok := bodyMap["stream"].(bool); ok && stream {
-				isStreamingRequest = true
-			}
-		}
-	}
+	isStreamingRequest := isStreamingBody(bodyBytes)
 
-	// Add timeout context only for non-streaming requests
+	// Non-streaming requests get a total timeout. Streams are watched for a
+	// first byte and for idle gaps instead, since generation may run for minutes.
+	// The context lives until the response body is closed.
+	timeout := time.Duration(config.Retry.Timeout) * time.Second
+	if backend.Timeout > 0 {
+		timeout = time.Duration(backend.Timeout) * time.Second
+	}
+	firstByteTimeout := config.Streaming.FirstByteTimeout
+	if backend.FirstByteTimeout != 0 {
+		firstByteTimeout = backend.FirstByteTimeout
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var watchdog *streamWatchdog
+	deadlineBound := false // The request deadline is shorter than the backend's timeout
 	if !isStreamingRequest {
-		ctx, cancel := context.WithTimeout(originalReq.Context(), time.Duration(ps.config.Retry.Timeout)*time.Second)
-		defer cancel()
-		req = req.WithContext(ctx)
-		log.Printf("[超时设置] %s - 非流式请求,设置 %d 秒超时", backend.Name, ps.config.Retry.Timeout)
+		if !deadline.IsZero() && time.Until(deadline) < timeout {
+			timeout = time.Until(deadline)
+			deadlineBound = true
+		}
+		ctx, cancel = context.WithTimeout(originalReq.Context(), timeout)
+		logger.Debug("[超时设置] 非流式请求", "timeout_seconds", timeout.Seconds())
+	} else {
+		ctx, cancel = context.WithCancel(originalReq.Context())
+		watchdog = newStreamWatchdog(cancel,
+			secondsOrDisabled(firstByteTimeout), secondsOrDisabled(config.Streaming.IdleTimeout), deadline)
 	}
+	req = req.WithContext(ctx)
 
 	for key, values := range originalReq.Header {
 		for _, value := range values {
@@ -303,27 +593,52 @@ func (ps *ProxyServer) forwardRequest(state *BackendState, originalReq *http.Req
 		}
 	}
 
-	req.Header.Set("Authorization", "Bearer "+backend.Token)
+	// Replace client credentials with the backend token in the platform's auth scheme
+	applyBackendAuth(req, backend)
 
-	resp, err := ps.client.Do(req)
+	sendTime := time.Now()
+	resp, err := client.Do(req)
 	if err != nil {
+		// A timeout shortened to fit the request deadline says nothing about the backend
+		deadlineExceeded := deadlineBound && errors.Is(ctx.Err(), context.DeadlineExceeded)
+		cancel()
 		// Network error or timeout
-		ps.circuitBreaker.RecordFailure(state, 0)
+		ps.metrics.RecordUpstreamResponse(backend.Name, 0, 0)
+		if watchdog != nil {
+			if timeoutErr := watchdog.stop(); timeoutErr != nil {
+				if !timeoutErr.deadline {
+					ps.circuitBreaker.RecordFailure(state, 0)
+				}
+				logger.Warn("[超时] 流式请求首字节超时", "error", timeoutErr)
+				return nil, true, &networkError{err: timeoutErr, timeout: true}
+			}
+		}
+		if !deadlineExceeded {
+			ps.circuitBreaker.RecordFailure(state, 0)
+		}
 		// Check if it's a timeout error
-		if strings.Contains(err.Error(), "timeout") || strings.Contains(err.Error(), "deadline exceeded") {
-			log.Printf("[超时] %s - 请求超时 (%d 秒)", backend.Name, ps.config.Retry.Timeout)
+		isTimeout := strings.Contains(err.Error(), "timeout") || strings.Contains(err.Error(), "deadline exceeded")
+		if isTimeout {
+			logger.Warn("[超时] 请求超时", "timeout_seconds", timeout.Seconds())
 		}
-		return nil, true, err
+		return nil, true, &networkError{err: err, timeout: isTimeout}
+	}
+	if watchdog != nil {
+		resp.Body = &watchedBody{ReadCloser: resp.Body, watchdog: watchdog}
+	} else {
+		resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
 	}
+	ps.metrics.RecordUpstreamResponse(backend.Name, resp.StatusCode, time.Since(sendTime))
+	ps.circuitBreaker.RecordRateLimitHeaders(state, resp.Header)
 
 	// Handle non-2xx responses
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		bodyBytes, readErr := readResponseBody(resp)
+		bodyBytes, readErr := readResponseBody(resp, logger)
 		resp.Body.Close()
 
 		if readErr != nil {
 			ps.circuitBreaker.RecordFailure(state, resp.StatusCode)
-			return nil, true, fmt.Errorf("后端返回错误: HTTP %d (读取响应体失败: %v)", resp.StatusCode, readErr)
+			return nil, true, &upstreamStatusError{statusCode: resp.StatusCode, detail: fmt.Sprintf("读取响应体失败: %v", readErr)}
 		}
 
 		bodyStr := string(bodyBytes)
@@ -332,24 +647,56 @@ func (ps *ProxyServer) forwardRequest(state *BackendState, originalReq *http.Req
 		}
 
 		// Log error response for debugging
-		log.Printf("[错误详情] %s - HTTP %d - 响应: %s", backend.Name, resp.StatusCode, bodyStr)
+		logger.Warn("[错误详情]", "status", resp.StatusCode, "body", bodyStr)
+
+		// Out of credit/quota: retrying this backend soon cannot help, whatever the status
+		if resp.StatusCode < 500 && isQuotaExhausted(resp.StatusCode, bodyBytes, config.Failover.Quota.patterns) {
+			ps.circuitBreaker.Quarantine(state, time.Duration(config.Failover.Quota.QuarantineSeconds)*time.Second,
+				fmt.Sprintf("HTTP %d 配额耗尽", resp.StatusCode))
+			return nil, true, &upstreamStatusError{statusCode: resp.StatusCode, detail: "配额耗尽"}
+		}
+
+		// Rules see the upstream's own body, e.g. OpenAI error codes the conversion drops
+		rule := matchFailoverRule(config.Failover.Rules, resp.StatusCode, bodyBytes)
+
+		// Errors passed on to the client must be in the Anthropic format
+		if platform == "openai" {
+			bodyBytes = convertOpenAIError(resp, bodyBytes)
+		}
 
 		// Classify errors
 		switch {
 		case resp.StatusCode == 429:
 			// Rate limit - record and retry
-			retryAfter := resp.Header.Get("Retry-After")
-			ps.circuitBreaker.Record429(state, retryAfter)
-			return nil, true, fmt.Errorf("后端返回错误: HTTP %d", resp.StatusCode)
+			ps.circuitBreaker.Record429(state, resp.Header)
+			ps.metrics.RecordRateLimited(backend.Name)
+			return nil, true, &upstreamStatusError{statusCode: resp.StatusCode}
 
 		case resp.StatusCode >= 500:
 			// Server error - record failure and retry
 			ps.circuitBreaker.RecordFailure(state, resp.StatusCode)
-			return nil, true, fmt.Errorf("后端返回错误: HTTP %d", resp.StatusCode)
+			return nil, true, &upstreamStatusError{statusCode: resp.StatusCode}
 
+		}
+
+		// 4xx: failover rules decide whether another backend may accept the request
+		if rule != nil && rule.Action != FailoverActionReturn {
+			detail := "规则 " + rule.Name
+			if rule.Action == FailoverActionDisable {
+				ps.circuitBreaker.DisableFor(state, rule.disableDuration(), fmt.Sprintf("HTTP %d (%s)", resp.StatusCode, detail))
+			} else {
+				// The backend answered properly, it just can't serve this request
+				ps.circuitBreaker.RecordSuccess(state)
+			}
+			logger.Warn("[故障转移规则] 尝试下一个后端", "status", resp.StatusCode, "rule", rule.Name, "action", rule.Action)
+			resp.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+			return nil, true, &upstreamStatusError{statusCode: resp.StatusCode, detail: detail, rejected: resp}
+		}
+
+		switch {
 		case resp.StatusCode == 401 || resp.StatusCode == 403:
 			// Auth error - don't retry, return immediately
-			log.Printf("[认证错误] %s - HTTP %d,不重试", backend.Name, resp.StatusCode)
+			logger.Warn("[认证错误] 不重试", "status", resp.StatusCode)
 			resp.Body = io.NopCloser(bytes.NewReader(bodyBytes))
 			return resp, false, nil
 
@@ -360,154 +707,191 @@ func (ps *ProxyServer) forwardRequest(state *BackendState, originalReq *http.Req
 		}
 	}
 
-	// Success - record and return
-	ps.circuitBreaker.RecordSuccess(state)
+	// Success - record and return. Streams are judged when they end, since
+	// errors can still arrive in-band after the 200 (see recordStreamResult).
+	if !isEventStream(resp) {
+		ps.circuitBreaker.RecordSuccess(state)
+	}
 
 	// Convert response format if needed
 	if platform == "openai" {
-		return ps.convertOpenAIResponse(resp)
+		return ps.convertOpenAIResponse(resp, backend, requestedModel, logger)
 	}
 
 	return resp, false, nil
 }
 
 // readResponseBody reads response body, automatically handles gzip and zstd compression
-func readResponseBody(resp *http.Response) ([]byte, error) {
+func readResponseBody(resp *http.Response, logger *slog.Logger) ([]byte, error) {
 	var reader io.Reader = resp.Body
 	contentEncoding := resp.Header.Get("Content-Encoding")
 
-	log.Printf("[readResponseBody] Content-Encoding 头: '%s'", contentEncoding)
+	logger.Debug("[readResponseBody] 读取响应体", "content_encoding", contentEncoding)
 
 	// Handle gzip compression
 	if strings.EqualFold(contentEncoding, "gzip") {
-		log.Printf("[readResponseBody] 检测到 gzip 压缩,尝试解压")
+		logger.Debug("[readResponseBody] 检测到 gzip 压缩,尝试解压")
 		gzipReader, err := gzip.NewReader(resp.Body)
 		if err != nil {
-			log.Printf("[readResponseBody] gzip 解压失败: %v", err)
+			logger.Debug("[readResponseBody] gzip 解压失败", "error", err)
 			return io.ReadAll(resp.Body)
 		}
 		defer gzipReader.Close()
 		reader = gzipReader
-		log.Printf("[readResponseBody] gzip 解压器创建成功")
+		logger.Debug("[readResponseBody] gzip 解压器创建成功")
 	}
 
 	// Handle zstd compression
 	if strings.EqualFold(contentEncoding, "zstd") {
-		log.Printf("[readResponseBody] 检测到 zstd 压缩,尝试解压")
+		logger.Debug("[readResponseBody] 检测到 zstd 压缩,尝试解压")
 		zstdReader, err := zstd.NewReader(resp.Body)
 		if err != nil {
-			log.Printf("[readResponseBody] zstd 解压失败: %v", err)
+			logger.Debug("[readResponseBody] zstd 解压失败", "error", err)
 			return io.ReadAll(resp.Body)
 		}
 		defer zstdReader.Close()
 		reader = zstdReader
-		log.Printf("[readResponseBody] zstd 解压器创建成功")
+		logger.Debug("[readResponseBody] zstd 解压器创建成功")
 	}
 
 	data, err := io.ReadAll(reader)
 	if err != nil {
 		// Check if we got any data before the error
 		if len(data) > 0 {
-			log.Printf("[readResponseBody] 读取时出错 %v,但已读取 %d 字节数据", err, len(data))
+			logger.Debug("[readResponseBody] 读取时出错,返回已读取的数据", "error", err, "bytes", len(data))
 			return data, nil // Return partial data instead of error
 		}
 		return nil, err
 	}
 
-	log.Printf("[readResponseBody] 读取了 %d 字节数据", len(data))
+	logger.Debug("[readResponseBody] 读取完成", "bytes", len(data))
 
 	// Check if data looks like gzip even without header (magic bytes: 1f 8b)
 	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b && contentEncoding == "" {
-		log.Printf("[readResponseBody] 检测到未声明的 gzip 数据,尝试解压")
+		logger.Debug("[readResponseBody] 检测到未声明的 gzip 数据,尝试解压")
 		gzipReader, err := gzip.NewReader(bytes.NewReader(data))
 		if err != nil {
-			log.Printf("[readResponseBody] 未声明的 gzip 解压失败: %v", err)
+			logger.Debug("[readResponseBody] 未声明的 gzip 解压失败", "error", err)
 			return data, nil
 		}
 		defer gzipReader.Close()
 		decompressed, err := io.ReadAll(gzipReader)
 		if err != nil {
-			log.Printf("[readResponseBody] 读取解压数据失败: %v", err)
+			logger.Debug("[readResponseBody] 读取解压数据失败", "error", err)
 			return data, nil
 		}
-		log.Printf("[readResponseBody] 成功解压未声明的 gzip 数据: %d -> %d 字节", len(data), len(decompressed))
+		logger.Debug("[readResponseBody] 成功解压未声明的 gzip 数据", "bytes", len(data), "decompressed_bytes", len(decompressed))
 		return decompressed, nil
 	}
 
 	// Check if data looks like zstd even without header (magic bytes: 28 b5 2f fd)
 	if len(data) > 4 && data[0] == 0x28 && data[1] == 0xb5 && data[2] == 0x2f && data[3] == 0xfd && contentEncoding == "" {
-		log.Printf("[readResponseBody] 检测到未声明的 zstd 数据,尝试解压")
+		logger.Debug("[readResponseBody] 检测到未声明的 zstd 数据,尝试解压")
 		zstdReader, err := zstd.NewReader(bytes.NewReader(data))
 		if err != nil {
-			log.Printf("[readResponseBody] 未声明的 zstd 解压失败: %v", err)
+			logger.Debug("[readResponseBody] 未声明的 zstd 解压失败", "error", err)
 			return data, nil
 		}
 		defer zstdReader.Close()
 		decompressed, err := io.ReadAll(zstdReader)
 		if err != nil {
-			log.Printf("[readResponseBody] 读取解压数据失败: %v", err)
+			logger.Debug("[readResponseBody] 读取解压数据失败", "error", err)
 			return data, nil
 		}
-		log.Printf("[readResponseBody] 成功解压未声明的 zstd 数据: %d -> %d 字节", len(data), len(decompressed))
+		logger.Debug("[readResponseBody] 成功解压未声明的 zstd 数据", "bytes", len(data), "decompressed_bytes", len(decompressed))
 		return decompressed, nil
 	}
 
 	return data, nil
 }
 
-// copyResponse copies response to client
-func (ps *ProxyServer) copyResponse(w http.ResponseWriter, resp *http.Response) {
+// copyResponse copies response to client and returns the token usage found in it.
+// Usage is read from message_start/message_delta events of a stream, or from
+// the body of an uncompressed JSON response.
+func (ps *ProxyServer) copyResponse(w http.ResponseWriter, resp *http.Response, logger *slog.Logger) tokenUsage {
 	defer resp.Body.Close()
 
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
-	}
+	writeResponseHeader(w, resp)
 
-	w.WriteHeader(resp.StatusCode)
+	var usage tokenUsage
+	contentType := resp.Header.Get("Content-Type")
+	encoded := resp.Header.Get("Content-Encoding") != "" && !strings.EqualFold(resp.Header.Get("Content-Encoding"), "identity")
 
 	// Check if this is a streaming response
-	contentType := resp.Header.Get("Content-Type")
 	if strings.Contains(contentType, "text/event-stream") {
+		parser := &sseParser{onEvent: func(event, data string) {
+			if event == "message_start" || event == "message_delta" {
+				usage.mergeEventData([]byte(data))
+			}
+		}}
+		var body io.Reader = resp.Body
+		if !encoded {
+			body = io.TeeReader(resp.Body, parser)
+		}
+
 		// For streaming responses, use chunked copying with flushing
 		flusher, ok := w.(http.Flusher)
 		if !ok {
-			log.Printf("[复制响应] 警告: ResponseWriter 不支持 Flusher 接口")
+			logger.Warn("[复制响应] ResponseWriter 不支持 Flusher 接口")
 			// Fallback to regular copy
-			_, err := io.Copy(w, resp.Body)
-			if err != nil {
-				log.Printf("[复制响应] 写入失败: %v", err)
+			if _, err := io.Copy(w, body); err != nil {
+				logger.Warn("[复制响应] 写入失败", "error", err)
 			}
-			return
+			parser.Flush()
+			return usage
 		}
 
 		// Copy with periodic flushing for streaming
 		buf := make([]byte, 8192) // 8KB buffer
 		for {
-			n, err := resp.Body.Read(buf)
+			n, err := body.Read(buf)
 			if n > 0 {
 				_, writeErr := w.Write(buf[:n])
 				if writeErr != nil {
-					log.Printf("[复制响应] 流式写入失败: %v", writeErr)
-					return
+					logger.Warn("[复制响应] 流式写入失败", "error", writeErr)
+					return usage
 				}
 				flusher.Flush() // Immediately flush to client
 			}
 			if err != nil {
 				if err != io.EOF {
-					log.Printf("[复制响应] 流式读取失败: %v", err)
+					logger.Warn("[复制响应] 流式读取失败", "error", err)
 				}
 				break
 			}
 		}
-	} else {
-		// For non-streaming responses, use regular copy
-		_, err := io.Copy(w, resp.Body)
-		if err != nil {
-			log.Printf("[复制响应] 写入失败: %v", err)
+		parser.Flush()
+		return usage
+	}
+
+	// For non-streaming responses, use regular copy
+	var captured bytes.Buffer
+	var body io.Reader = resp.Body
+	if !encoded && strings.Contains(contentType, "json") {
+		body = io.TeeReader(resp.Body, &captured)
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		logger.Warn("[复制响应] 写入失败", "error", err)
+	}
+	if captured.Len() > 0 {
+		usage.mergeEventData(captured.Bytes())
+	}
+	return usage
+}
+
+// writeResponseHeader copies upstream headers and the status code to the client
+func writeResponseHeader(w http.ResponseWriter, resp *http.Response) {
+	for key, values := range resp.Header {
+		// The client gets our request ID, not the upstream's
+		if key == requestIDHeader {
+			continue
+		}
+		for _, value := range values {
+			w.Header().Add(key, value)
 		}
 	}
+
+	w.WriteHeader(resp.StatusCode)
 }
 
 // convertAnthropicToOpenAI converts Anthropic request format to OpenAI format
@@ -523,6 +907,11 @@ func (ps *ProxyServer) convertAnthropicToOpenAI(bodyBytes []byte) ([]byte, error
 		Stream:    anthropicReq.Stream,
 	}
 
+	// Ask for a trailing usage chunk so streamed responses can report real token counts
+	if anthropicReq.Stream {
+		openaiReq.StreamOptions = &openaiStreamOptions{IncludeUsage: true}
+	}
+
 	// Convert temperature if present
 	if anthropicReq.Temperature != nil {
 		openaiReq.Temperature = *anthropicReq.Temperature
@@ -817,15 +1206,16 @@ func convertToolChoice(v any) any {
 }
 
 // convertOpenAIResponse converts OpenAI response to Anthropic format
-func (ps *ProxyServer) convertOpenAIResponse(resp *http.Response) (*http.Response, bool, error) {
+func (ps *ProxyServer) convertOpenAIResponse(resp *http.Response, backend Backend, requestedModel string, logger *slog.Logger) (*http.Response, bool, error) {
 	// Check if this is a streaming response
 	contentType := resp.Header.Get("Content-Type")
 	if strings.Contains(contentType, "text/event-stream") {
-		return ps.convertOpenAIStreamResponse(resp)
+		return ps.convertOpenAIStreamResponse(resp, backend, requestedModel, logger)
 	}
 
 	// Handle non-streaming response
-	bodyBytes, err := readResponseBody(resp)
+	bodyBytes, err := readResponseBody(resp, logger)
+	resp.Body.Close()
 	if err != nil {
 		return resp, true, fmt.Errorf("读取响应体失败: %v", err)
 	}
@@ -850,18 +1240,95 @@ func (ps *ProxyServer) convertOpenAIResponse(resp *http.Response) (*http.Respons
 	newResp.Header.Set("Content-Type", "application/json")
 	newResp.ContentLength = int64(len(convertedBody))
 
-	log.Printf("[响应转换] OpenAI 格式已转换为 Anthropic 格式")
+	logger.Debug("[响应转换] OpenAI 格式已转换为 Anthropic 格式")
 	return &newResp, false, nil
 }
 
+// convertOpenAIError rewrites an OpenAI error body as an Anthropic error with
+// the original message, so clients can react to the error type (Claude Code
+// compacts the conversation on "prompt is too long"). Bodies that are not
+// OpenAI errors are returned unchanged.
+func convertOpenAIError(resp *http.Response, bodyBytes []byte) []byte {
+	var payload struct {
+		Type  string          `json:"type"`
+		Error json.RawMessage `json:"error"`
+	}
+	// Gateways in front of OpenAI models may already answer in Anthropic format
+	if json.Unmarshal(bodyBytes, &payload) != nil || len(payload.Error) == 0 || payload.Type == "error" {
+		return bodyBytes
+	}
+	var openaiErr struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+		Code    any    `json:"code"` // String for OpenAI, sometimes a number for compatible servers
+	}
+	if json.Unmarshal(payload.Error, &openaiErr) != nil {
+		// Some compatible servers send {"error": "message"}
+		if json.Unmarshal(payload.Error, &openaiErr.Message) != nil {
+			return bodyBytes
+		}
+	}
+
+	errType, message := anthropicErrorForOpenAI(resp.StatusCode, fmt.Sprint(openaiErr.Code), openaiErr.Message)
+	converted, err := json.Marshal(map[string]any{
+		"type": "error",
+		"error": map[string]any{
+			"type":    errType,
+			"message": message,
+		},
+	})
+	if err != nil {
+		return bodyBytes
+	}
+
+	// The body was decompressed by readResponseBody
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Type", "application/json")
+	resp.ContentLength = int64(len(converted))
+	return converted
+}
+
+// anthropicErrorForOpenAI maps an OpenAI error to the Anthropic error type for
+// the same status. Context overflows get Anthropic's "prompt is too long" wording.
+func anthropicErrorForOpenAI(status int, code, message string) (string, string) {
+	if code == "context_length_exceeded" || strings.Contains(message, "maximum context length") {
+		return "invalid_request_error", "prompt is too long: " + message
+	}
+	if message == "" {
+		message = http.StatusText(status)
+	}
+
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication_error", message
+	case status == http.StatusForbidden:
+		return "permission_error", message
+	case status == http.StatusNotFound:
+		return "not_found_error", message
+	case status == http.StatusRequestEntityTooLarge:
+		return "request_too_large", message
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error", message
+	case status == http.StatusServiceUnavailable || status == 529:
+		return "overloaded_error", message
+	case status == http.StatusGatewayTimeout:
+		return "timeout_error", message
+	case status >= 500:
+		return "api_error", message
+	default:
+		return "invalid_request_error", message
+	}
+}
+
 // convertOpenAIStreamResponse handles streaming response conversion
-func (ps *ProxyServer) convertOpenAIStreamResponse(resp *http.Response) (*http.Response, bool, error) {
-	log.Printf("[流式响应转换] 开始转换 OpenAI 流式响应为 Anthropic 格式")
+func (ps *ProxyServer) convertOpenAIStreamResponse(resp *http.Response, backend Backend, requestedModel string, logger *slog.Logger) (*http.Response, bool, error) {
+	logger.Debug("[流式响应转换] 开始转换 OpenAI 流式响应为 Anthropic 格式")
 
 	// Create a pipe to stream the converted response
 	reader, writer := io.Pipe()
 	newResp := *resp
-	newResp.Body = reader
+	newResp.Body = &convertedStreamBody{PipeReader: reader, upstream: resp.Body}
 	newResp.Header.Set("Content-Type", "text/event-stream")
 	newResp.Header.Set("Cache-Control", "no-cache")
 	newResp.Header.Set("Connection", "keep-alive")
@@ -869,16 +1336,31 @@ func (ps *ProxyServer) convertOpenAIStreamResponse(resp *http.Response) (*http.R
 	newResp.ContentLength = -1 // Unknown length for streaming
 
 	// Start conversion in a goroutine
+	// A read error (including a watchdog timeout) reaches the relay instead of a clean EOF
 	go func() {
-		defer writer.Close()
-		ps.streamOpenAIToAnthropic(resp.Body, writer)
+		writer.CloseWithError(ps.streamOpenAIToAnthropic(resp.Body, writer, backend, requestedModel, logger))
 	}()
 
 	return &newResp, false, nil
 }
 
+// convertedStreamBody is the client side of a converted stream. Closing it also
+// closes the upstream body so the converter stops when the relay gives up.
+type convertedStreamBody struct {
+	*io.PipeReader
+	upstream io.Closer
+}
+
+func (b *convertedStreamBody) Close() error {
+	b.PipeReader.Close()
+	return b.upstream.Close()
+}
+
 // streamOpenAIToAnthropic converts OpenAI streaming format to Anthropic streaming format
-func (ps *ProxyServer) streamOpenAIToAnthropic(upstreamBody io.ReadCloser, writer *io.PipeWriter) {
+// The message_start event is deferred until the first upstream chunk so that
+// its id and model can be taken from the backend's response. It returns the
+// upstream read error, if any.
+func (ps *ProxyServer) streamOpenAIToAnthropic(upstreamBody io.ReadCloser, writer *io.PipeWriter, backend Backend, requestedModel string, logger *slog.Logger) error {
 	defer upstreamBody.Close()
 
 	// Create a buffered writer for flushing
@@ -898,23 +1380,43 @@ func (ps *ProxyServer) streamOpenAIToAnthropic(upstreamBody io.ReadCloser, write
 		return nil
 	}
 
-	messageID := fmt.Sprintf("msg_%d", time.Now().UnixMilli())
-	_ = encoder("message_start", map[string]any{
-		"type": "message_start",
-		"message": map[string]any{
-			"id":            messageID,
-			"type":          "message",
-			"role":          "assistant",
-			"model":         "gpt-4", // This should be extracted from the request
-			"content":       []any{},
-			"stop_reason":   nil,
-			"stop_sequence": nil,
-			"usage": map[string]any{
-				"input_tokens":  0,
-				"output_tokens": 0,
+	messageStarted := false
+	startMessage := func(chunkID, chunkModel string) {
+		if messageStarted {
+			return
+		}
+		messageStarted = true
+
+		messageID := chunkID
+		if messageID == "" {
+			messageID = fmt.Sprintf("msg_%d", time.Now().UnixMilli())
+		}
+		// Backend override wins, then what the upstream reports, then what the client asked for
+		model := backend.Model
+		if model == "" {
+			model = chunkModel
+		}
+		if model == "" {
+			model = requestedModel
+		}
+
+		_ = encoder("message_start", map[string]any{
+			"type": "message_start",
+			"message": map[string]any{
+				"id":            messageID,
+				"type":          "message",
+				"role":          "assistant",
+				"model":         model,
+				"content":       []any{},
+				"stop_reason":   nil,
+				"stop_sequence": nil,
+				"usage": map[string]any{
+					"input_tokens":  0,
+					"output_tokens": 0,
+				},
 			},
-		},
-	})
+		})
+	}
 
 	bufReader := bufio.NewReader(upstreamBody)
 	chunkCount := 0
@@ -924,7 +1426,24 @@ func (ps *ProxyServer) streamOpenAIToAnthropic(upstreamBody io.ReadCloser, write
 	nextContentBlockIndex := 0
 	currentContentBlockIndex := -1
 	currentBlockType := "" // "text" | "tool_use"
-	hasTextBlock := false
+
+	// Tool calls are keyed by their OpenAI index. Parallel calls may interleave
+	// their argument fragments, but Anthropic blocks cannot be reopened, so only
+	// the first call is streamed live (once its name is known); the others are
+	// buffered and emitted in order when the upstream stream ends. Text that
+	// arrives after tool calls have begun is emitted after them.
+	type streamToolCall struct {
+		id         string
+		name       string
+		blockIndex int
+		started    bool
+		args       strings.Builder // Fragments not yet emitted
+	}
+	var usage *openaiUsage
+	toolCalls := make(map[int]*streamToolCall)
+	toolOrder := make([]int, 0)
+	var liveTool *streamToolCall
+	var trailingText strings.Builder
 
 	assignContentBlockIndex := func() int {
 		idx := nextContentBlockIndex
@@ -943,14 +1462,77 @@ func (ps *ProxyServer) streamOpenAIToAnthropic(upstreamBody io.ReadCloser, write
 		}
 	}
 
+	emitToolArgs := func(tc *streamToolCall, args string) {
+		if args == "" {
+			return
+		}
+		_ = encoder("content_block_delta", map[string]any{
+			"type":  "content_block_delta",
+			"index": tc.blockIndex,
+			"delta": map[string]any{
+				"type":         "input_json_delta",
+				"partial_json": args,
+			},
+		})
+	}
+
+	startToolBlock := func(openaiIndex int, tc *streamToolCall) {
+		closeCurrentBlock()
+		if tc.id == "" {
+			tc.id = fmt.Sprintf("toolu_%d_%d", time.Now().UnixMilli(), openaiIndex)
+		}
+		tc.blockIndex = assignContentBlockIndex()
+		tc.started = true
+		_ = encoder("content_block_start", map[string]any{
+			"type":  "content_block_start",
+			"index": tc.blockIndex,
+			"content_block": map[string]any{
+				"type":  "tool_use",
+				"id":    tc.id,
+				"name":  tc.name,
+				"input": map[string]any{},
+			},
+		})
+		currentContentBlockIndex = tc.blockIndex
+		currentBlockType = "tool_use"
+		emitToolArgs(tc, tc.args.String())
+		tc.args.Reset()
+	}
+
+	startTextBlock := func() {
+		closeCurrentBlock()
+		idx := assignContentBlockIndex()
+		_ = encoder("content_block_start", map[string]any{
+			"type":  "content_block_start",
+			"index": idx,
+			"content_block": map[string]any{
+				"type": "text",
+				"text": "",
+			},
+		})
+		currentContentBlockIndex = idx
+		currentBlockType = "text"
+	}
+
+	emitText := func(text string) {
+		_ = encoder("content_block_delta", map[string]any{
+			"type":  "content_block_delta",
+			"index": currentContentBlockIndex,
+			"delta": map[string]any{
+				"type": "text_delta",
+				"text": text,
+			},
+		})
+	}
+
 	for {
 		line, err := bufReader.ReadString('\n')
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				break
 			}
-			log.Printf("[流式转换错误] 读取上游响应失败: %v", err)
-			return
+			logger.Warn("[流式转换错误] 读取上游响应失败", "error", err)
+			return err
 		}
 		line = strings.TrimRight(line, "\r\n")
 		if line == "" || strings.HasPrefix(line, ":") {
@@ -965,17 +1547,15 @@ func (ps *ProxyServer) streamOpenAIToAnthropic(upstreamBody io.ReadCloser, write
 			break
 		}
 
-		var chunk struct {
-			Choices []struct {
-				Delta struct {
-					Content *string `json:"content,omitempty"`
-				} `json:"delta"`
-				FinishReason *string `json:"finish_reason,omitempty"`
-			} `json:"choices"`
-		}
+		var chunk openaiChatCompletionChunk
 		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
 			continue
 		}
+		startMessage(chunk.ID, chunk.Model)
+		// The usage chunk usually arrives last with an empty choices array
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
 		if len(chunk.Choices) == 0 {
 			continue
 		}
@@ -986,76 +1566,94 @@ func (ps *ProxyServer) streamOpenAIToAnthropic(upstreamBody io.ReadCloser, write
 		// Handle text content
 		if delta.Content != nil && *delta.Content != "" {
 			textChars += len([]rune(*delta.Content))
-			// If we were in a tool block, close it before starting/continuing text.
-			if currentBlockType != "" && currentBlockType != "text" {
-				closeCurrentBlock()
+			switch {
+			case len(toolCalls) > 0:
+				trailingText.WriteString(*delta.Content)
+			case currentBlockType == "text":
+				emitText(*delta.Content)
+			default:
+				startTextBlock()
+				emitText(*delta.Content)
 			}
-			if !hasTextBlock {
-				hasTextBlock = true
-				idx := assignContentBlockIndex()
-				_ = encoder("content_block_start", map[string]any{
-					"type":  "content_block_start",
-					"index": idx,
-					"content_block": map[string]any{
-						"type": "text",
-						"text": "",
-					},
-				})
-				currentContentBlockIndex = idx
-				currentBlockType = "text"
+		}
+
+		// Handle tool call fragments
+		for _, frag := range delta.ToolCalls {
+			tc, ok := toolCalls[frag.Index]
+			if !ok {
+				tc = &streamToolCall{}
+				toolCalls[frag.Index] = tc
+				toolOrder = append(toolOrder, frag.Index)
+			}
+			if frag.ID != "" && !tc.started {
+				tc.id = frag.ID
+			}
+			if frag.Function.Name != "" && !tc.started {
+				tc.name += frag.Function.Name
+			}
+
+			if tc.started {
+				emitToolArgs(tc, frag.Function.Arguments)
+				continue
+			}
+			tc.args.WriteString(frag.Function.Arguments)
+			if liveTool == nil && tc.name != "" && frag.Index == toolOrder[0] {
+				startToolBlock(frag.Index, tc)
+				liveTool = tc
 			}
-			_ = encoder("content_block_delta", map[string]any{
-				"type":  "content_block_delta",
-				"index": currentContentBlockIndex,
-				"delta": map[string]any{
-					"type": "text_delta",
-					"text": *delta.Content,
-				},
-			})
 		}
 
 		if chunk.Choices[0].FinishReason != nil {
 			finishReason = *chunk.Choices[0].FinishReason
-			stopReason := mapFinishReason(*chunk.Choices[0].FinishReason)
-			_ = encoder("message_delta", map[string]any{
-				"type": "message_delta",
-				"delta": map[string]any{
-					"stop_reason":   stopReason,
-					"stop_sequence": nil,
-				},
-				"usage": map[string]any{
-					"input_tokens":            0,
-					"output_tokens":           0,
-					"cache_read_input_tokens": 0,
-				},
-			})
 		}
 	}
 
+	// Upstream may end without sending any parsable chunk
+	startMessage("", "")
+
+	// No more fragments can arrive: emit the buffered tool calls (including
+	// any whose name never arrived) and the text that followed them.
+	for _, idx := range toolOrder {
+		if tc := toolCalls[idx]; !tc.started {
+			startToolBlock(idx, tc)
+		}
+	}
+	if trailingText.Len() > 0 {
+		startTextBlock()
+		emitText(trailingText.String())
+	}
+
 	// Close any open content block (text or tool_use).
 	closeCurrentBlock()
 
-	// Ensure message_delta is always emitted before message_stop.
-	if finishReason == "" {
-		_ = encoder("message_delta", map[string]any{
-			"type": "message_delta",
-			"delta": map[string]any{
-				"stop_reason":   "end_turn",
-				"stop_sequence": nil,
-			},
-			"usage": map[string]any{
-				"input_tokens":            0,
-				"output_tokens":           0,
-				"cache_read_input_tokens": 0,
-			},
-		})
+	stopReason := mapFinishReason(finishReason)
+	if len(toolCalls) > 0 && stopReason == "end_turn" {
+		// Some providers report "stop" even when the turn ended with tool calls.
+		stopReason = "tool_use"
 	}
 
+	// message_delta must follow the last content_block_stop and precede message_stop.
+	inputTokens, outputTokens, cacheRead := usage.anthropicUsage()
+	_ = encoder("message_delta", map[string]any{
+		"type": "message_delta",
+		"delta": map[string]any{
+			"stop_reason":   stopReason,
+			"stop_sequence": nil,
+		},
+		"usage": map[string]any{
+			"input_tokens":            inputTokens,
+			"output_tokens":           outputTokens,
+			"cache_read_input_tokens": cacheRead,
+		},
+	})
+
 	_ = encoder("message_stop", map[string]any{
 		"type": "message_stop",
 	})
 
-	log.Printf("[流式转换完成] chunks=%d text_chars=%d finish_reason=%q saw_done=%v", chunkCount, textChars, finishReason, sawDone)
+	logger.Debug("[流式转换完成]", "chunks", chunkCount, "text_chars", textChars,
+		"tool_calls", len(toolCalls), "finish_reason", finishReason, "saw_done", sawDone)
+	return nil
 }
 
 // convertOpenAIToAnthropic converts OpenAI response to Anthropic format
@@ -1098,16 +1696,7 @@ func (ps *ProxyServer) convertOpenAIToAnthropic(resp openaiChatCompletionRespons
 	}
 
 	// Calculate token usage
-	inputTokens := 0
-	outputTokens := 0
-	cacheRead := 0
-	if resp.Usage != nil {
-		if resp.Usage.PromptTokensDetails != nil {
-			cacheRead = resp.Usage.PromptTokensDetails.CachedTokens
-		}
-		inputTokens = resp.Usage.PromptTokens - cacheRead
-		outputTokens = resp.Usage.CompletionTokens
-	}
+	inputTokens, outputTokens, cacheRead := resp.Usage.anthropicUsage()
 
 	return map[string]any{
 		"id":            resp.ID,
@@ -1125,6 +1714,34 @@ func (ps *ProxyServer) convertOpenAIToAnthropic(resp openaiChatCompletionRespons
 	}
 }
 
+// isStreamingBody reports whether a JSON request body asks for a streamed response
+func isStreamingBody(bodyBytes []byte) bool {
+	if len(bodyBytes) == 0 {
+		return false
+	}
+	var req struct {
+		Stream bool `json:"stream"`
+	}
+	if err := json.Unmarshal(bodyBytes, &req); err != nil {
+		return false
+	}
+	return req.Stream
+}
+
+// extractRequestModel returns the model field of a JSON request body, if any
+func extractRequestModel(bodyBytes []byte) string {
+	if len(bodyBytes) == 0 {
+		return ""
+	}
+	var req struct {
+		Model string `json:"model"`
+	}
+	if err := json.Unmarshal(bodyBytes, &req); err != nil {
+		return ""
+	}
+	return req.Model
+}
+
 // mapFinishReason maps OpenAI finish reason to Anthropic format
 func mapFinishReason(finish string) string {
 	switch finish {
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// convertStream runs OpenAI SSE data payloads through the stream converter and
+// returns the Anthropic events it produced
+func convertStream(t *testing.T, payloads ...string) []map[string]any {
+	t.Helper()
+
+	var upstream strings.Builder
+	for _, p := range payloads {
+		upstream.WriteString("data: " + p + "\n\n")
+	}
+	upstream.WriteString("data: [DONE]\n\n")
+
+	reader, writer := io.Pipe()
+	ps := &ProxyServer{}
+	go func() {
+		writer.CloseWithError(ps.streamOpenAIToAnthropic(io.NopCloser(strings.NewReader(upstream.String())), writer, Backend{Name: "oa"}, "m", slog.Default()))
+	}()
+	out, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("转换失败: %v", err)
+	}
+
+	var events []map[string]any
+	parser := &sseParser{onEvent: func(event, data string) {
+		var payload map[string]any
+		if err := json.Unmarshal([]byte(data), &payload); err != nil {
+			t.Fatalf("事件 %s 不是 JSON: %s", event, data)
+		}
+		events = append(events, payload)
+	}}
+	parser.Write(out)
+	parser.Flush()
+	return events
+}
+
+// toolInputs joins the input_json_delta fragments of every tool_use block
+func toolInputs(t *testing.T, events []map[string]any) map[string]string {
+	t.Helper()
+
+	names := make(map[float64]string)
+	inputs := make(map[string]string)
+	for _, ev := range events {
+		index, _ := ev["index"].(float64)
+		switch ev["type"] {
+		case "content_block_start":
+			block := ev["content_block"].(map[string]any)
+			if block["type"] == "tool_use" {
+				names[index] = block["name"].(string)
+				inputs[names[index]] = ""
+			}
+		case "content_block_delta":
+			delta := ev["delta"].(map[string]any)
+			if delta["type"] == "input_json_delta" {
+				name, ok := names[index]
+				if !ok {
+					t.Fatalf("参数片段指向未打开的内容块 %v", index)
+				}
+				inputs[name] += delta["partial_json"].(string)
+			}
+		}
+	}
+	return inputs
+}
+
+func stopReason(events []map[string]any) string {
+	for _, ev := range events {
+		if ev["type"] == "message_delta" {
+			return ev["delta"].(map[string]any)["stop_reason"].(string)
+		}
+	}
+	return ""
+}
+
+func TestStreamOpenAIToAnthropicParallelToolCalls(t *testing.T) {
+	events := convertStream(t,
+		`{"id":"c1","choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_a","function":{"name":"read","arguments":"{\"a\""}}]}}]}`,
+		`{"id":"c1","choices":[{"delta":{"tool_calls":[{"index":1,"id":"call_b","function":{"name":"list","arguments":"{}"}}]}}]}`,
+		`{"id":"c1","choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":":1}"}}]}}]}`,
+		`{"id":"c1","choices":[{"delta":{},"finish_reason":"tool_calls"}]}`,
+	)
+
+	inputs := toolInputs(t, events)
+	if inputs["read"] != `{"a":1}` || inputs["list"] != `{}` {
+		t.Fatalf("工具参数不完整: %v", inputs)
+	}
+	for name, input := range inputs {
+		if !json.Valid([]byte(input)) {
+			t.Errorf("%s 的参数不是合法 JSON: %s", name, input)
+		}
+	}
+	if got := stopReason(events); got != "tool_use" {
+		t.Errorf("stop_reason = %q, want tool_use", got)
+	}
+}
+
+func TestStreamOpenAIToAnthropicBlockOrder(t *testing.T) {
+	events := convertStream(t,
+		`{"id":"c1","choices":[{"delta":{"content":"先看看"}}]}`,
+		`{"id":"c1","choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_a","function":{"name":"read","arguments":"{\"p\":"}}]}}]}`,
+		`{"id":"c1","choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"x\"}"}}]}}]}`,
+		`{"id":"c1","choices":[{"delta":{"content":"好的"}}]}`,
+		`{"id":"c1","choices":[{"delta":{},"finish_reason":"tool_calls"}]}`,
+	)
+
+	// Blocks must be started and stopped strictly one after another
+	var blocks []string
+	open := -1.0
+	for _, ev := range events {
+		index, _ := ev["index"].(float64)
+		switch ev["type"] {
+		case "content_block_start":
+			if open >= 0 {
+				t.Fatalf("内容块 %v 在 %v 关闭前打开", index, open)
+			}
+			open = index
+			blocks = append(blocks, ev["content_block"].(map[string]any)["type"].(string))
+		case "content_block_delta":
+			if index != open {
+				t.Fatalf("内容块 %v 的片段在块 %v 打开时发送", index, open)
+			}
+		case "content_block_stop":
+			open = -1
+		}
+	}
+	if strings.Join(blocks, ",") != "text,tool_use,text" {
+		t.Errorf("内容块顺序 = %v", blocks)
+	}
+	if inputs := toolInputs(t, events); inputs["read"] != `{"p":"x"}` {
+		t.Errorf("工具参数 = %v", inputs)
+	}
+}
+
+// newTestProxy starts the proxy with the given config file content
+func newTestProxy(t *testing.T, config string) (*ProxyServer, *httptest.Server) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ps, err := NewProxyServer(path)
+	if err != nil {
+		t.Fatalf("NewProxyServer: %v", err)
+	}
+	srv := httptest.NewServer(ps)
+	t.Cleanup(srv.Close)
+	return ps, srv
+}
+
+func TestFailoverRuleMatchesRawOpenAIError(t *testing.T) {
+	openai := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":{"message":"The model does not exist","type":"invalid_request_error","code":"model_not_found"}}`)
+	}))
+	defer openai.Close()
+	anthropic := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"type":"message","content":[]}`)
+	}))
+	defer anthropic.Close()
+
+	_, srv := newTestProxy(t, fmt.Sprintf(`{
+		"backends": [
+			{"name": "oa", "base_url": %q, "platform": "openai", "enabled": true},
+			{"name": "an", "base_url": %q, "enabled": true}
+		],
+		"failover": {"rules": [{"name": "unknown-model", "status": [400], "body_pattern": "model_not_found", "action": "failover"}]}
+	}`, openai.URL, anthropic.URL))
+
+	resp, err := http.Post(srv.URL+"/v1/messages", "application/json", strings.NewReader(`{"model":"m","messages":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("status = %d, 应由下一个后端返回 200: %s", resp.StatusCode, body)
+	}
+}
+
+func TestAnthropicErrorForOpenAI(t *testing.T) {
+	tests := []struct {
+		status  int
+		errType string
+	}{
+		{http.StatusBadRequest, "invalid_request_error"},
+		{http.StatusUnauthorized, "authentication_error"},
+		{http.StatusForbidden, "permission_error"},
+		{http.StatusNotFound, "not_found_error"},
+		{http.StatusRequestEntityTooLarge, "request_too_large"},
+		{http.StatusTooManyRequests, "rate_limit_error"},
+		{http.StatusInternalServerError, "api_error"},
+		{http.StatusBadGateway, "api_error"},
+		{http.StatusServiceUnavailable, "overloaded_error"},
+		{529, "overloaded_error"},
+		{http.StatusGatewayTimeout, "timeout_error"},
+	}
+	for _, tt := range tests {
+		errType, message := anthropicErrorForOpenAI(tt.status, "", "")
+		if errType != tt.errType || message != http.StatusText(tt.status) {
+			t.Errorf("HTTP %d: %s %q, want %s", tt.status, errType, message, tt.errType)
+		}
+	}
+
+	errType, message := anthropicErrorForOpenAI(http.StatusBadRequest, "context_length_exceeded", "too many tokens")
+	if errType != "invalid_request_error" || message != "prompt is too long: too many tokens" {
+		t.Errorf("上下文超长: %s %q", errType, message)
+	}
+	_, message = anthropicErrorForOpenAI(http.StatusBadRequest, "", "This model's maximum context length is 8192 tokens")
+	if !strings.HasPrefix(message, "prompt is too long: ") {
+		t.Errorf("按消息识别上下文超长失败: %q", message)
+	}
+}
+
+func TestConvertOpenAIError(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string // Empty when the body must pass through unchanged
+	}{
+		{"openai object", http.StatusTooManyRequests,
+			`{"error":{"message":"Rate limit reached","type":"requests","code":"rate_limit_exceeded"}}`,
+			`{"error":{"message":"Rate limit reached","type":"rate_limit_error"},"type":"error"}`},
+		{"string error", http.StatusUnauthorized, `{"error":"invalid api key"}`,
+			`{"error":{"message":"invalid api key","type":"authentication_error"},"type":"error"}`},
+		{"numeric code", http.StatusBadRequest, `{"error":{"message":"bad","code":400}}`,
+			`{"error":{"message":"bad","type":"invalid_request_error"},"type":"error"}`},
+		{"context overflow", http.StatusBadRequest, `{"error":{"message":"too long","code":"context_length_exceeded"}}`,
+			`{"error":{"message":"prompt is too long: too long","type":"invalid_request_error"},"type":"error"}`},
+		{"anthropic body", http.StatusBadRequest, `{"type":"error","error":{"type":"invalid_request_error","message":"x"}}`, ""},
+		{"no error field", http.StatusBadGateway, `{"detail":"upstream down"}`, ""},
+		{"not json", http.StatusBadGateway, `<html>Bad Gateway</html>`, ""},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Header: http.Header{"Content-Encoding": {"gzip"}}}
+		got := string(convertOpenAIError(resp, []byte(tt.body)))
+		if tt.want == "" {
+			if got != tt.body || resp.Header.Get("Content-Encoding") != "gzip" {
+				t.Errorf("%s: 非 OpenAI 错误体被修改: %s", tt.name, got)
+			}
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+		if resp.Header.Get("Content-Encoding") != "" || resp.ContentLength != int64(len(got)) {
+			t.Errorf("%s: 响应头未随转换后的响应体更新: %v", tt.name, resp.Header)
+		}
+	}
+}
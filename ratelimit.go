@@ -0,0 +1,146 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// anthropicRateLimits are the limit names of Anthropic's anthropic-ratelimit-<name>-remaining/-reset headers
+var anthropicRateLimits = []string{"requests", "tokens", "input-tokens", "output-tokens"}
+
+// rateLimitDelay works out how long a backend asked us to wait after a 429.
+// Retry-After (delta-seconds or HTTP-date) wins; otherwise the latest reset time
+// of an exhausted Anthropic limit is used. ok is false when the response gave
+// no usable hint. source names the header the delay came from, for logging.
+func rateLimitDelay(header http.Header, now time.Time) (delay time.Duration, source string, ok bool) {
+	if header == nil {
+		return 0, "", false
+	}
+
+	if value := strings.TrimSpace(header.Get("Retry-After")); value != "" {
+		if d, ok := parseRetryAfter(value, now); ok {
+			return d, "Retry-After", true
+		}
+	}
+
+	var latest time.Time
+	for _, name := range anthropicRateLimits {
+		if strings.TrimSpace(header.Get("anthropic-ratelimit-"+name+"-remaining")) != "0" {
+			continue
+		}
+		reset, err := time.Parse(time.RFC3339, strings.TrimSpace(header.Get("anthropic-ratelimit-"+name+"-reset")))
+		if err == nil && reset.After(latest) {
+			latest = reset
+			source = "anthropic-ratelimit-" + name + "-reset"
+		}
+	}
+	if !latest.IsZero() {
+		return clampDelay(latest.Sub(now)), source, true
+	}
+
+	return 0, "", false
+}
+
+// parseRetryAfter accepts delta-seconds (fractions tolerated) or an HTTP-date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if seconds < 0 || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+			return 0, false
+		}
+		return clampDelay(time.Duration(seconds * float64(time.Second))), true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return clampDelay(at.Sub(now)), true
+	}
+	return 0, false
+}
+
+// clampDelay keeps a cooldown of at least one second: a reset time already in
+// the past (or clock skew) must not turn a 429 into an immediate retry loop
+func clampDelay(d time.Duration) time.Duration {
+	if d < time.Second {
+		return time.Second
+	}
+	return d
+}
+
+// openAIRateLimits are the limit names of OpenAI's x-ratelimit-{limit,remaining,reset}-<name> headers
+var openAIRateLimits = []string{"requests", "tokens"}
+
+// headroomTTL bounds how long a reading without a reset time is trusted
+const headroomTTL = time.Minute
+
+// rateLimitHeadroom is the latest state a backend reported for one of its limits
+type rateLimitHeadroom struct {
+	limit     int64 // 0 when not reported
+	remaining int64
+	reset     time.Time // When the limit refills; zero when not reported
+	updated   time.Time
+}
+
+// parseRateLimitHeadroom reads the remaining-capacity headers that Anthropic
+// (anthropic-ratelimit-<name>-*) and OpenAI (x-ratelimit-*-<name>) send on
+// every response, keyed by limit name. Limits without a remaining value are
+// left out.
+func parseRateLimitHeadroom(header http.Header, now time.Time) map[string]rateLimitHeadroom {
+	readings := make(map[string]rateLimitHeadroom)
+
+	for _, name := range anthropicRateLimits {
+		prefix := "anthropic-ratelimit-" + name + "-"
+		remaining, ok := parseHeaderInt(header.Get(prefix + "remaining"))
+		if !ok {
+			continue
+		}
+		limit, _ := parseHeaderInt(header.Get(prefix + "limit"))
+		reset, _ := time.Parse(time.RFC3339, strings.TrimSpace(header.Get(prefix+"reset")))
+		readings[name] = rateLimitHeadroom{limit: limit, remaining: remaining, reset: reset, updated: now}
+	}
+
+	for _, name := range openAIRateLimits {
+		if _, ok := readings[name]; ok {
+			continue
+		}
+		remaining, ok := parseHeaderInt(header.Get("x-ratelimit-remaining-" + name))
+		if !ok {
+			continue
+		}
+		limit, _ := parseHeaderInt(header.Get("x-ratelimit-limit-" + name))
+		var reset time.Time
+		// OpenAI reports the reset as a duration such as "6m0s" or "20ms"
+		if d, err := time.ParseDuration(strings.TrimSpace(header.Get("x-ratelimit-reset-" + name))); err == nil && d >= 0 {
+			reset = now.Add(d)
+		}
+		readings[name] = rateLimitHeadroom{limit: limit, remaining: remaining, reset: reset, updated: now}
+	}
+
+	return readings
+}
+
+func parseHeaderInt(value string) (int64, bool) {
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	return n, err == nil && n >= 0
+}
+
+// current reports whether the reading still describes the limit: once the reset
+// time has passed the limit has refilled
+func (h rateLimitHeadroom) current(now time.Time) bool {
+	if !h.reset.IsZero() {
+		return now.Before(h.reset)
+	}
+	return now.Sub(h.updated) < headroomTTL
+}
+
+// low reports whether the limit is about to run dry: nothing is left, or at
+// most ratio of the limit remains
+func (h rateLimitHeadroom) low(now time.Time, ratio float64) bool {
+	if ratio < 0 || !h.current(now) {
+		return false
+	}
+	if h.remaining == 0 {
+		return true
+	}
+	return h.limit > 0 && float64(h.remaining) <= ratio*float64(h.limit)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"30", 30 * time.Second, true},
+		{"1.5", 1500 * time.Millisecond, true},
+		{"0", time.Second, true}, // Clamped: never retry immediately
+		{now.Add(2 * time.Minute).Format(http.TimeFormat), 2 * time.Minute, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), time.Second, true},
+		{"-5", 0, false},
+		{"NaN", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v; want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	reset := func(d time.Duration) string { return now.Add(d).Format(time.RFC3339) }
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+		source string
+		ok     bool
+	}{
+		{"nil header", nil, 0, "", false},
+		{"no hint", http.Header{}, 0, "", false},
+		{"retry-after wins", http.Header{
+			"Retry-After":                          {"7"},
+			"Anthropic-Ratelimit-Tokens-Remaining": {"0"},
+			"Anthropic-Ratelimit-Tokens-Reset":     {reset(time.Minute)},
+		}, 7 * time.Second, "Retry-After", true},
+		{"latest exhausted limit", http.Header{
+			"Anthropic-Ratelimit-Requests-Remaining":     {"0"},
+			"Anthropic-Ratelimit-Requests-Reset":         {reset(10 * time.Second)},
+			"Anthropic-Ratelimit-Input-Tokens-Remaining": {"0"},
+			"Anthropic-Ratelimit-Input-Tokens-Reset":     {reset(42 * time.Second)},
+		}, 42 * time.Second, "anthropic-ratelimit-input-tokens-reset", true},
+		{"limit not exhausted", http.Header{
+			"Anthropic-Ratelimit-Tokens-Remaining": {"1000"},
+			"Anthropic-Ratelimit-Tokens-Reset":     {reset(time.Minute)},
+		}, 0, "", false},
+		{"invalid retry-after falls back", http.Header{
+			"Retry-After":                          {"later"},
+			"Anthropic-Ratelimit-Tokens-Remaining": {"0"},
+			"Anthropic-Ratelimit-Tokens-Reset":     {reset(20 * time.Second)},
+		}, 20 * time.Second, "anthropic-ratelimit-tokens-reset", true},
+	}
+	for _, tt := range tests {
+		got, source, ok := rateLimitDelay(tt.header, now)
+		if got != tt.want || source != tt.source || ok != tt.ok {
+			t.Errorf("%s: rateLimitDelay = %v, %q, %v; want %v, %q, %v", tt.name, got, source, ok, tt.want, tt.source, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
+// Reload re-reads the config file and swaps it in atomically.
+// An invalid file is rejected and the running configuration is kept.
+// In-flight requests keep the settings and backend clients they started with;
+// enabled, breaker and cooldown state are shared and change immediately.
+func (ps *ProxyServer) Reload() error {
+	ps.reloadMu.Lock()
+	defer ps.reloadMu.Unlock()
+
+	config, err := loadConfig(ps.configPath)
+	if err != nil {
+		log.Printf("[配置重载] 失败,继续使用当前配置: %v", err)
+		return err
+	}
+
+	ps.configMu.RLock()
+	previousClients := ps.clients
+	ps.configMu.RUnlock()
+	clients, err := buildBackendClients(config, previousClients)
+	if err != nil {
+		log.Printf("[配置重载] 失败,继续使用当前配置: %v", err)
+		return err
+	}
+
+	ps.configMu.Lock()
+	old := ps.config
+	ps.config = config
+	ps.clients = clients
+	ps.configMu.Unlock()
+
+	ps.circuitBreaker.Reload(config)
+
+	level, _ := parseLogLevel(config.Logging.Level)
+	logLevel.Set(level)
+
+	// Listeners are bound at startup and cannot move without a restart
+	if config.Port != old.Port {
+		log.Printf("[配置重载] 警告: port 变更 (%d → %d) 需重启后生效", old.Port, config.Port)
+	}
+	if config.Admin.Port != old.Admin.Port {
+		log.Printf("[配置重载] 警告: admin.port 变更 (%d → %d) 需重启后生效", old.Admin.Port, config.Admin.Port)
+	}
+	if config.Logging.Format != old.Logging.Format {
+		log.Printf("[配置重载] 警告: logging.format 变更 (%s → %s) 需重启后生效", old.Logging.Format, config.Logging.Format)
+	}
+
+	log.Printf("[配置重载] 成功 - %d 个后端", len(config.Backends))
+	return nil
+}
+
+// watchConfig polls the config file and reloads it whenever its modification
+// time or size changes. It returns when ctx is cancelled.
+func (ps *ProxyServer) watchConfig(ctx context.Context, interval time.Duration) {
+	lastMod, lastSize := statConfig(ps.configPath)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			mod, size := statConfig(ps.configPath)
+			if mod.IsZero() || (mod.Equal(lastMod) && size == lastSize) {
+				continue
+			}
+			lastMod, lastSize = mod, size
+			log.Printf("[配置重载] 检测到配置文件变更: %s", ps.configPath)
+			ps.Reload()
+		}
+	}
+}
+
+// statConfig returns the modification time and size of the config file,
+// or zero values when it cannot be read (e.g. mid-replace by an editor)
+func statConfig(path string) (time.Time, int64) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, 0
+	}
+	return info.ModTime(), info.Size()
+}
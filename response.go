@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[写入响应] 失败: %v", err)
+	}
+}
+
+// writeAnthropicError writes an error in the Anthropic API format so that
+// Claude Code and SDK clients can parse it:
+//
+//	{"type":"error","error":{"type":"authentication_error","message":"..."}}
+func writeAnthropicError(w http.ResponseWriter, status int, errType, message string) {
+	writeJSON(w, status, map[string]any{
+		"type": "error",
+		"error": map[string]any{
+			"type":    errType,
+			"message": message,
+		},
+	})
+}
+
+// writeAnthropicStreamError writes an Anthropic error event into an event
+// stream whose headers have already been sent to the client
+func writeAnthropicStreamError(w io.Writer, errType, message string) error {
+	data, err := json.Marshal(map[string]any{
+		"type": "error",
+		"error": map[string]any{
+			"type":    errType,
+			"message": message,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+	return err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// networkError marks a request that never got an HTTP response from the backend
+// (connection refused/reset, DNS failure, timeout, ...)
+type networkError struct {
+	err     error
+	timeout bool
+}
+
+func (e *networkError) Error() string { return e.err.Error() }
+func (e *networkError) Unwrap() error { return e.err }
+
+// upstreamStatusError marks a non-2xx backend response that triggers failover
+type upstreamStatusError struct {
+	statusCode int
+	detail     string
+	rejected   *http.Response // 4xx sent elsewhere by a failover rule, passed on if no backend accepts the request
+}
+
+func (e *upstreamStatusError) Error() string {
+	if e.detail != "" {
+		return fmt.Sprintf("后端返回错误: HTTP %d (%s)", e.statusCode, e.detail)
+	}
+	return fmt.Sprintf("后端返回错误: HTTP %d", e.statusCode)
+}
+
+// errorStatusCode returns the HTTP status carried by an attempt error, or 0 when
+// the backend never produced a response
+func errorStatusCode(err error) int {
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode
+	}
+	return 0
+}
+
+// isTransientNetworkError reports whether err is a network failure worth retrying
+// on the same backend. Timeouts are excluded: waiting the full timeout again on a
+// slow backend is worse than moving on to the next one.
+func isTransientNetworkError(err error) bool {
+	var netErr *networkError
+	return errors.As(err, &netErr) && !netErr.timeout
+}
+
+// backoffDelay returns the wait before the given retry (0-based) using exponential
+// backoff capped at max, with "equal jitter": half fixed, half random.
+func backoffDelay(retry int, initial, max time.Duration) time.Duration {
+	delay := initial
+	for i := 0; i < retry && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + rand.N(half)
+}
+
+// sleepUntil waits for d, returning false early if ctx is done or the wait
+// would run past deadline (zero deadline means no limit)
+func sleepUntil(ctx context.Context, d time.Duration, deadline time.Time) bool {
+	if !deadline.IsZero() && time.Now().Add(d).After(deadline) {
+		return false
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// capToDeadline limits a wait to the time left before the request deadline.
+// A zero d means no limit of its own; a zero deadline leaves d unchanged.
+func capToDeadline(d time.Duration, deadline time.Time) time.Duration {
+	if deadline.IsZero() {
+		return d
+	}
+	remaining := max(time.Until(deadline), time.Millisecond)
+	if d == 0 || remaining < d {
+		return remaining
+	}
+	return d
+}
+
+// failureKind groups attempt errors by what they say about backend capacity
+type failureKind int
+
+const (
+	failureOther       failureKind = iota // 5xx, connection error, broken stream
+	failureRateLimited                    // 429 / rate_limit_error
+	failureOverloaded                     // 503, 529 / overloaded_error
+	failureTimeout                        // Timeouts, 504
+)
+
+func classifyFailure(err error) failureKind {
+	status := errorStatusCode(err)
+	var eventErr *streamEventError
+	if errors.As(err, &eventErr) {
+		status = eventErr.statusCode()
+	}
+	switch status {
+	case http.StatusTooManyRequests:
+		return failureRateLimited
+	case http.StatusServiceUnavailable, 529:
+		return failureOverloaded
+	case http.StatusGatewayTimeout, http.StatusRequestTimeout:
+		return failureTimeout
+	}
+
+	var netErr *networkError
+	var timeoutErr *streamTimeoutError
+	if (errors.As(err, &netErr) && netErr.timeout) || errors.As(err, &timeoutErr) || errors.Is(err, context.DeadlineExceeded) {
+		return failureTimeout
+	}
+	return failureOther
+}
+
+// allFailedError picks the status and Anthropic error type returned when no
+// backend could serve a request, from what the attempts actually ran into:
+//   - no attempt made (every backend skipped): 503 overloaded_error
+//   - every attempt rate limited: 429 rate_limit_error
+//   - any backend overloaded or rate limited: 529 overloaded_error
+//   - every attempt timed out, or the request deadline ran out: 504 timeout_error
+//   - otherwise: 502 api_error
+func allFailedError(failures []error, deadlineExceeded bool) (int, string) {
+	if len(failures) == 0 {
+		if deadlineExceeded {
+			return http.StatusGatewayTimeout, "timeout_error"
+		}
+		return http.StatusServiceUnavailable, "overloaded_error"
+	}
+
+	counts := make(map[failureKind]int)
+	for _, err := range failures {
+		counts[classifyFailure(err)]++
+	}
+	switch {
+	case counts[failureRateLimited] == len(failures):
+		return http.StatusTooManyRequests, "rate_limit_error"
+	case counts[failureOverloaded] > 0 || counts[failureRateLimited] > 0:
+		return 529, "overloaded_error"
+	case counts[failureTimeout] == len(failures) || deadlineExceeded:
+		return http.StatusGatewayTimeout, "timeout_error"
+	default:
+		return http.StatusBadGateway, "api_error"
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAllFailedError(t *testing.T) {
+	rateLimited := &upstreamStatusError{statusCode: http.StatusTooManyRequests}
+	overloaded := &upstreamStatusError{statusCode: 529}
+	serverError := &upstreamStatusError{statusCode: http.StatusInternalServerError}
+	timeout := &networkError{err: context.DeadlineExceeded, timeout: true}
+	connRefused := &networkError{err: errors.New("connection refused")}
+
+	tests := []struct {
+		name             string
+		failures         []error
+		deadlineExceeded bool
+		status           int
+		errType          string
+	}{
+		{"every backend skipped", nil, false, http.StatusServiceUnavailable, "overloaded_error"},
+		{"deadline before any attempt", nil, true, http.StatusGatewayTimeout, "timeout_error"},
+		{"all rate limited", []error{rateLimited, rateLimited}, false, http.StatusTooManyRequests, "rate_limit_error"},
+		{"rate limited in stream", []error{&streamEventError{errType: "rate_limit_error"}}, false, http.StatusTooManyRequests, "rate_limit_error"},
+		{"rate limited and failing", []error{rateLimited, serverError}, false, 529, "overloaded_error"},
+		{"overloaded", []error{serverError, overloaded}, false, 529, "overloaded_error"},
+		{"all timed out", []error{timeout, &streamTimeoutError{firstByte: true, after: time.Second}}, false, http.StatusGatewayTimeout, "timeout_error"},
+		{"deadline ran out", []error{serverError}, true, http.StatusGatewayTimeout, "timeout_error"},
+		{"mixed errors", []error{serverError, connRefused, timeout}, false, http.StatusBadGateway, "api_error"},
+	}
+	for _, tt := range tests {
+		status, errType := allFailedError(tt.failures, tt.deadlineExceeded)
+		if status != tt.status || errType != tt.errType {
+			t.Errorf("%s: allFailedError = %d %s, want %d %s", tt.name, status, errType, tt.status, tt.errType)
+		}
+	}
+}
+
+func TestCapToDeadline(t *testing.T) {
+	if got := capToDeadline(time.Minute, time.Time{}); got != time.Minute {
+		t.Errorf("无截止时间: %v", got)
+	}
+	if got := capToDeadline(time.Minute, time.Now().Add(time.Second)); got > time.Second {
+		t.Errorf("未按截止时间截断: %v", got)
+	}
+	if got := capToDeadline(0, time.Now().Add(time.Second)); got <= 0 || got > time.Second {
+		t.Errorf("无自身限制时应使用剩余时间: %v", got)
+	}
+	if got := capToDeadline(time.Minute, time.Now().Add(-time.Second)); got <= 0 {
+		t.Errorf("截止时间已过时不能返回非正值 (会关闭超时): %v", got)
+	}
+}
+
+func TestDeadlineBoundTimeoutNotChargedToBackend(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body) // Lets the server notice the proxy hanging up
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer upstream.Close()
+
+	for _, body := range []string{`{"model":"m","messages":[]}`, `{"model":"m","stream":true,"messages":[]}`} {
+		ps, srv := newTestProxy(t, fmt.Sprintf(`{
+			"backends": [{"name": "slow", "base_url": %q, "enabled": true}],
+			"retry": {"timeout_seconds": 30, "request_deadline_seconds": 1},
+			"streaming": {"first_byte_timeout_seconds": 30}
+		}`, upstream.URL))
+
+		resp, err := http.Post(srv.URL+"/v1/messages", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusGatewayTimeout {
+			t.Errorf("%s: status = %d, want 504", body, resp.StatusCode)
+		}
+		if got := ps.circuitBreaker.GetBackendState("slow").ConsecutiveFailures; got != 0 {
+			t.Errorf("%s: 请求总时限导致的超时被记为后端失败 %d 次", body, got)
+		}
+	}
+}
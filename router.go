@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// routeMatcher is the compiled form of a RouteMatch
+type routeMatcher struct {
+	model   *regexp.Regexp
+	path    *regexp.Regexp
+	headers map[string]*regexp.Regexp
+}
+
+// compileRouteMatch compiles globs and regular expressions of a route once at load time
+func compileRouteMatch(match RouteMatch) (*routeMatcher, error) {
+	m := &routeMatcher{}
+
+	if match.Model != "" && match.ModelRegex != "" {
+		return nil, fmt.Errorf("model 和 model_regex 不能同时设置")
+	}
+	if match.Model != "" {
+		m.model = globToRegexp(match.Model)
+	}
+	if match.ModelRegex != "" {
+		re, err := regexp.Compile(match.ModelRegex)
+		if err != nil {
+			return nil, fmt.Errorf("model_regex: %w", err)
+		}
+		m.model = re
+	}
+	if match.Path != "" {
+		m.path = globToRegexp(match.Path)
+	}
+	if len(match.Headers) > 0 {
+		m.headers = make(map[string]*regexp.Regexp, len(match.Headers))
+		for name, pattern := range match.Headers {
+			m.headers[http.CanonicalHeaderKey(name)] = globToRegexp(pattern)
+		}
+	}
+
+	return m, nil
+}
+
+// globToRegexp converts a glob where "*" matches any run of characters (including "/")
+// and "?" matches a single character into an anchored regular expression
+func globToRegexp(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// matches reports whether a request satisfies every condition of the route
+func (m *routeMatcher) matches(r *http.Request, model string) bool {
+	if m.model != nil && !m.model.MatchString(model) {
+		return false
+	}
+	if m.path != nil && !m.path.MatchString(r.URL.Path) {
+		return false
+	}
+	for name, re := range m.headers {
+		if !re.MatchString(r.Header.Get(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchRoute returns the first route matching the request, or nil
+func matchRoute(routes []Route, r *http.Request, model string) *Route {
+	for i := range routes {
+		if routes[i].matcher != nil && routes[i].matcher.matches(r, model) {
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+// setRequestModel replaces the model field of a JSON request body.
+// The body is returned unchanged if it is not a JSON object.
+func setRequestModel(bodyBytes []byte, model string) ([]byte, bool) {
+	if len(bodyBytes) == 0 {
+		return bodyBytes, false
+	}
+	var bodyMap map[string]any
+	if err := json.Unmarshal(bodyBytes, &bodyMap); err != nil {
+		return bodyBytes, false
+	}
+	bodyMap["model"] = model
+	modifiedBody, err := json.Marshal(bodyMap)
+	if err != nil {
+		return bodyBytes, false
+	}
+	return modifiedBody, true
+}
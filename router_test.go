@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob  string
+		input string
+		want  bool
+	}{
+		{"claude-*haiku*", "claude-3-5-haiku-20241022", true},
+		{"claude-*haiku*", "claude-sonnet-4", false},
+		{"claude-*", "my-claude-opus", false},     // Anchored at the start
+		{"*-haiku", "claude-haiku-latest", false}, // Anchored at the end
+		{"gpt-?o", "gpt-4o", true},
+		{"gpt-?o", "gpt-40o", false},
+		{"gpt-4.1", "gpt-4x1", false}, // Dots are literal
+		{"v1/(beta)+", "v1/(beta)+", true},
+		{"v1/(beta)+", "v1/betabeta", false},
+		{"", "", true},
+		{"", "x", false},
+	}
+	for _, tt := range tests {
+		if got := globToRegexp(tt.glob).MatchString(tt.input); got != tt.want {
+			t.Errorf("glob %q 匹配 %q = %v, want %v", tt.glob, tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestMatchRoute(t *testing.T) {
+	var routes []Route
+	for _, route := range []Route{
+		{Name: "beta-haiku", Match: RouteMatch{Model: "*haiku*", Headers: map[string]string{"anthropic-beta": "*tools*"}}},
+		{Name: "haiku", Match: RouteMatch{Model: "*haiku*"}},
+		{Name: "count", Match: RouteMatch{Path: "/v1/messages/count_tokens"}},
+		{Name: "opus", Match: RouteMatch{ModelRegex: `^claude-opus-4(-\d+)?$`}},
+	} {
+		matcher, err := compileRouteMatch(route.Match)
+		if err != nil {
+			t.Fatalf("%s: %v", route.Name, err)
+		}
+		route.matcher = matcher
+		routes = append(routes, route)
+	}
+
+	tests := []struct {
+		path   string
+		model  string
+		header http.Header
+		want   string // Empty when no route matches
+	}{
+		{"/v1/messages", "claude-3-haiku", http.Header{"Anthropic-Beta": {"fine-grained-tools-2025"}}, "beta-haiku"},
+		{"/v1/messages", "claude-3-haiku", http.Header{"Anthropic-Beta": {"prompt-caching"}}, "haiku"},
+		{"/v1/messages", "claude-3-haiku", nil, "haiku"},
+		{"/v1/messages/count_tokens", "claude-sonnet-4", nil, "count"},
+		{"/v1/messages", "claude-opus-4-1", nil, "opus"},
+		{"/v1/messages", "claude-opus-4-1-fast", nil, ""},
+		{"/v1/messages", "claude-sonnet-4", nil, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, tt.path, nil)
+		for name, values := range tt.header {
+			r.Header[name] = values
+		}
+		got := ""
+		if route := matchRoute(routes, r, tt.model); route != nil {
+			got = route.Name
+		}
+		if got != tt.want {
+			t.Errorf("%s %s %v: 路由 = %q, want %q", tt.path, tt.model, tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// sseParser incrementally splits a server-sent event stream into events.
+// Bytes are fed as they are copied to the client; onEvent is called once per
+// complete event with its event name (may be empty) and joined data lines.
+type sseParser struct {
+	onEvent func(event, data string)
+
+	partial []byte
+	event   string
+	data    []string
+}
+
+// Write feeds raw stream bytes; it never fails so it can sit behind io.TeeReader
+func (p *sseParser) Write(b []byte) (int, error) {
+	p.partial = append(p.partial, b...)
+	for {
+		idx := bytes.IndexByte(p.partial, '\n')
+		if idx < 0 {
+			break
+		}
+		line := strings.TrimRight(string(p.partial[:idx]), "\r")
+		p.partial = p.partial[idx+1:]
+		p.processLine(line)
+	}
+	return len(b), nil
+}
+
+// Flush dispatches a final event that was not terminated by a blank line
+func (p *sseParser) Flush() {
+	if len(p.partial) > 0 {
+		p.processLine(strings.TrimRight(string(p.partial), "\r"))
+		p.partial = nil
+	}
+	p.dispatch()
+}
+
+func (p *sseParser) processLine(line string) {
+	switch {
+	case line == "":
+		p.dispatch()
+	case strings.HasPrefix(line, ":"):
+		// Comment / keep-alive
+	case strings.HasPrefix(line, "event:"):
+		p.event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+	case strings.HasPrefix(line, "data:"):
+		p.data = append(p.data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+	}
+}
+
+func (p *sseParser) dispatch() {
+	if p.event == "" && len(p.data) == 0 {
+		return
+	}
+	if p.onEvent != nil {
+		p.onEvent(p.event, strings.Join(p.data, "\n"))
+	}
+	p.event = ""
+	p.data = nil
+}
+
+// tokenUsage is the token accounting of one Anthropic-format response
+type tokenUsage struct {
+	InputTokens         int
+	OutputTokens        int
+	CacheReadTokens     int
+	CacheCreationTokens int
+}
+
+// anthropicUsagePayload matches the usage object of messages, message_start and message_delta
+type anthropicUsagePayload struct {
+	InputTokens         *int `json:"input_tokens"`
+	OutputTokens        *int `json:"output_tokens"`
+	CacheReadTokens     *int `json:"cache_read_input_tokens"`
+	CacheCreationTokens *int `json:"cache_creation_input_tokens"`
+}
+
+// merge keeps the largest value seen for each field: message_start reports a
+// placeholder output count and message_delta reports the cumulative total.
+func (u *tokenUsage) merge(p *anthropicUsagePayload) {
+	if p == nil {
+		return
+	}
+	maxInto := func(dst *int, v *int) {
+		if v != nil && *v > *dst {
+			*dst = *v
+		}
+	}
+	maxInto(&u.InputTokens, p.InputTokens)
+	maxInto(&u.OutputTokens, p.OutputTokens)
+	maxInto(&u.CacheReadTokens, p.CacheReadTokens)
+	maxInto(&u.CacheCreationTokens, p.CacheCreationTokens)
+}
+
+// mergeEventData extracts usage from a streaming event payload or a whole message body
+func (u *tokenUsage) mergeEventData(data []byte) {
+	var payload struct {
+		Usage   *anthropicUsagePayload `json:"usage"`
+		Message *struct {
+			Usage *anthropicUsagePayload `json:"usage"`
+		} `json:"message"`
+	}
+	if json.Unmarshal(data, &payload) != nil {
+		return
+	}
+	u.merge(payload.Usage)
+	if payload.Message != nil {
+		u.merge(payload.Message.Usage)
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sseStream tracks a 2xx Anthropic-format event stream while it is relayed.
+// The start of the stream is held back until real content arrives, so that an
+// upstream failing early can still be retried on another backend without the
+// client noticing.
+type sseStream struct {
+	body     io.ReadCloser
+	parser   *sseParser
+	buffered []byte
+	usage    tokenUsage
+
+	started     bool              // message_start seen
+	content     bool              // content_block_delta, message_delta or message_stop seen
+	completed   bool              // message_stop seen
+	upstreamErr *streamEventError // error event sent by the upstream
+
+	pending chan streamRead // Read still running when awaitContent gave up waiting
+}
+
+// streamRead is the result of one read of the upstream body
+type streamRead struct {
+	data []byte
+	err  error
+}
+
+// streamEventError is an error event received inside an upstream event stream
+type streamEventError struct {
+	errType string
+	message string
+}
+
+// errClientGone reports that the client disconnected while its stream was
+// being relayed. The upstream request is canceled with it, so the resulting
+// read error says nothing about the backend.
+var errClientGone = errors.New("客户端已断开")
+
+func (e *streamEventError) Error() string {
+	return fmt.Sprintf("流内错误事件: %s: %s", e.errType, e.message)
+}
+
+// statusCode maps the error type to the HTTP status Anthropic uses for it when
+// the error is the backend's fault, or 0 for errors caused by the request
+func (e *streamEventError) statusCode() int {
+	switch e.errType {
+	case "rate_limit_error":
+		return http.StatusTooManyRequests
+	case "overloaded_error":
+		return 529
+	case "api_error":
+		return http.StatusInternalServerError
+	case "timeout_error":
+		return http.StatusGatewayTimeout
+	}
+	return 0
+}
+
+func newSSEStream(body io.ReadCloser) *sseStream {
+	s := &sseStream{body: body}
+	s.parser = &sseParser{onEvent: s.onEvent}
+	return s
+}
+
+// isEventStream reports whether a response should be relayed as an SSE stream
+func isEventStream(resp *http.Response) bool {
+	encoding := resp.Header.Get("Content-Encoding")
+	return strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") &&
+		(encoding == "" || strings.EqualFold(encoding, "identity"))
+}
+
+func (s *sseStream) onEvent(event, data string) {
+	switch event {
+	case "message_start":
+		s.started = true
+		s.usage.mergeEventData([]byte(data))
+	case "content_block_delta":
+		s.content = true
+	case "message_delta":
+		s.content = true
+		s.usage.mergeEventData([]byte(data))
+	case "message_stop":
+		s.content = true
+		s.completed = true
+	case "error":
+		if s.upstreamErr == nil {
+			s.upstreamErr = parseStreamEventError(data)
+		}
+	}
+}
+
+// parseStreamEventError reads {"type":"error","error":{"type":...,"message":...}}
+func parseStreamEventError(data string) *streamEventError {
+	var payload struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	json.Unmarshal([]byte(data), &payload)
+	if payload.Error.Type == "" {
+		payload.Error.Type = "api_error"
+	}
+	return &streamEventError{errType: payload.Error.Type, message: payload.Error.Message}
+}
+
+// awaitContent reads and buffers the stream until the first content event, or
+// until maxBytes are buffered or maxWait has elapsed (0 disables the time limit,
+// a negative maxBytes disables buffering). Nothing has been sent to the client
+// yet, so an error may fail over. Reads run in the background so that maxWait
+// also applies while the upstream is silent; relayStream picks up a read that
+// is still running. If the client's ctx ends first errClientGone is returned,
+// as there is nobody left to fail over for.
+func (s *sseStream) awaitContent(ctx context.Context, maxBytes int, maxWait time.Duration) error {
+	if maxBytes < 0 {
+		return nil
+	}
+	var expired <-chan time.Time
+	if maxWait > 0 {
+		timer := time.NewTimer(maxWait)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for !s.content && s.upstreamErr == nil {
+		if len(s.buffered) >= maxBytes {
+			return nil
+		}
+
+		if s.pending == nil {
+			s.pending = make(chan streamRead, 1)
+			go func(pending chan<- streamRead) {
+				buf := make([]byte, 8192)
+				n, err := s.body.Read(buf)
+				pending <- streamRead{data: buf[:n], err: err}
+			}(s.pending)
+		}
+		var result streamRead
+		select {
+		case result = <-s.pending:
+			s.pending = nil
+		case <-expired:
+			return nil
+		case <-ctx.Done():
+			return errClientGone
+		}
+
+		n, err := len(result.data), result.err
+		if n > 0 {
+			s.buffered = append(s.buffered, result.data...)
+			s.parser.Write(result.data)
+		}
+		if errors.Is(err, io.EOF) {
+			s.parser.Flush()
+			if s.upstreamErr != nil {
+				break
+			}
+			// A stream without message_start is not Anthropic-format; pass it through as-is
+			if s.content || (!s.started && len(s.buffered) > 0) {
+				return nil
+			}
+			return errors.New("流在返回内容前结束")
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return errClientGone
+			}
+			return fmt.Errorf("读取流失败: %w", err)
+		}
+	}
+	// Errors caused by the request (e.g. invalid_request_error) would recur on
+	// any backend, so they are relayed to the client instead
+	if s.upstreamErr != nil && s.upstreamErr.statusCode() != 0 {
+		return s.upstreamErr
+	}
+	return nil
+}
+
+// relayStream sends the buffered start of the stream and copies the rest,
+// flushing after every read. Once the client has received data a failing
+// upstream can no longer be retried, so the failure is reported to the client
+// as an Anthropic error event and returned for the circuit breaker. A client
+// that goes away yields errClientGone instead, without an error event.
+func (ps *ProxyServer) relayStream(ctx context.Context, w http.ResponseWriter, resp *http.Response, s *sseStream, logger *slog.Logger) (tokenUsage, error) {
+	defer resp.Body.Close()
+
+	writeResponseHeader(w, resp)
+	flusher, _ := w.(http.Flusher)
+	write := func(b []byte) bool {
+		if _, err := w.Write(b); err != nil {
+			logger.Warn("[复制响应] 流式写入失败", "error", err)
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+
+	if len(s.buffered) > 0 && !write(s.buffered) {
+		return s.usage, errClientGone
+	}
+	s.buffered = nil
+
+	buf := make([]byte, 8192)
+	for {
+		n, err := s.read(buf)
+		if n > 0 {
+			s.parser.Write(buf[:n])
+			if !write(buf[:n]) {
+				return s.usage, errClientGone
+			}
+		}
+		if err == nil {
+			continue
+		}
+
+		var streamErr error
+		if errors.Is(err, io.EOF) {
+			s.parser.Flush()
+			if s.upstreamErr != nil {
+				// The upstream's own error event has already been relayed
+				return s.usage, s.upstreamErr
+			}
+			if !s.started || s.completed {
+				return s.usage, nil
+			}
+			streamErr = errors.New("流在 message_stop 前中断")
+		} else {
+			if s.upstreamErr != nil {
+				return s.usage, s.upstreamErr
+			}
+			if ctx.Err() != nil {
+				// Nobody is left to send an error event to
+				return s.usage, errClientGone
+			}
+			streamErr = fmt.Errorf("读取流失败: %w", err)
+		}
+
+		logger.Warn("[流式中断] 已向客户端发送错误事件", "error", streamErr)
+		if writeAnthropicStreamError(w, "api_error", "upstream stream interrupted: "+streamErr.Error()) == nil && flusher != nil {
+			flusher.Flush()
+		}
+		return s.usage, streamErr
+	}
+}
+
+// read returns the next chunk of the upstream body, finishing first a read
+// that awaitContent left running
+func (s *sseStream) read(buf []byte) (int, error) {
+	if s.pending != nil {
+		result := <-s.pending
+		s.pending = nil
+		return copy(buf, result.data), result.err
+	}
+	return s.body.Read(buf)
+}
+
+// recordStreamResult updates the circuit breaker once a stream has ended or
+// failed. Success is only recorded here, not when the 2xx headers arrive, so a
+// backend that answers 200 and then reports overloaded_error in the stream does
+// not look healthy. Rate limit errors start the 429 cooldown; errors caused by
+// the request leave the backend healthy. A stream cut short by the client is
+// neither a success nor a failure. It reports whether the backend failed.
+func (ps *ProxyServer) recordStreamResult(state *BackendState, backendName string, streamErr error) bool {
+	if errors.Is(streamErr, errClientGone) {
+		return false
+	}
+	if streamErr == nil {
+		ps.circuitBreaker.RecordSuccess(state)
+		return false
+	}
+
+	// The backend was not given its full first-byte timeout
+	var timeoutErr *streamTimeoutError
+	if errors.As(streamErr, &timeoutErr) && timeoutErr.deadline {
+		return true
+	}
+
+	var eventErr *streamEventError
+	if !errors.As(streamErr, &eventErr) {
+		// Connection error or truncated stream
+		ps.circuitBreaker.RecordFailure(state, 0)
+		return true
+	}
+
+	switch status := eventErr.statusCode(); status {
+	case 0:
+		ps.circuitBreaker.RecordSuccess(state)
+		return false
+	case http.StatusTooManyRequests:
+		ps.circuitBreaker.Record429(state, nil)
+		ps.metrics.RecordRateLimited(backendName)
+	default:
+		ps.circuitBreaker.RecordFailure(state, status)
+	}
+	return true
+}
+
+// streamTimeoutError is raised by the watchdog when an upstream stream stalls
+type streamTimeoutError struct {
+	firstByte bool
+	after     time.Duration
+	deadline  bool // The request deadline was shorter than the backend's own limit
+}
+
+func (e *streamTimeoutError) Error() string {
+	if e.deadline {
+		return fmt.Sprintf("流式首字节超时 (%s, 已到请求总时限)", e.after.Round(time.Millisecond))
+	}
+	if e.firstByte {
+		return fmt.Sprintf("流式首字节超时 (%s)", e.after.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("流式空闲超时 (%s 未收到数据)", e.after)
+}
+
+// streamWatchdog cancels a streaming upstream request that stops sending data:
+// the first body byte must arrive within firstByte of sending the request, and
+// later reads may be at most idle apart. A zero duration disables that check.
+// The first-byte wait is also capped at the request deadline.
+type streamWatchdog struct {
+	cancel context.CancelFunc
+	idle   time.Duration
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	gotData bool
+	err     *streamTimeoutError
+}
+
+func newStreamWatchdog(cancel context.CancelFunc, firstByte, idle time.Duration, deadline time.Time) *streamWatchdog {
+	wd := &streamWatchdog{cancel: cancel, idle: idle}
+	limit := capToDeadline(firstByte, deadline)
+	if limit > 0 {
+		timeoutErr := &streamTimeoutError{firstByte: true, after: limit, deadline: limit != firstByte}
+		wd.timer = time.AfterFunc(limit, func() { wd.expire(timeoutErr) })
+	}
+	return wd
+}
+
+func (wd *streamWatchdog) expire(err *streamTimeoutError) {
+	wd.mu.Lock()
+	if wd.err == nil {
+		wd.err = err
+	}
+	wd.mu.Unlock()
+	wd.cancel()
+}
+
+// touch records that data arrived and restarts the idle timer
+func (wd *streamWatchdog) touch() {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+
+	if wd.err != nil {
+		return
+	}
+	wd.gotData = true
+	if wd.timer != nil {
+		wd.timer.Stop()
+		wd.timer = nil
+	}
+	if wd.idle > 0 {
+		idle := wd.idle
+		wd.timer = time.AfterFunc(idle, func() { wd.expire(&streamTimeoutError{after: idle}) })
+	}
+}
+
+// stop disarms the watchdog and returns the timeout that fired, if any
+func (wd *streamWatchdog) stop() *streamTimeoutError {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+
+	if wd.timer != nil {
+		wd.timer.Stop()
+		wd.timer = nil
+	}
+	return wd.err
+}
+
+// timedOut returns the timeout that fired, if any
+func (wd *streamWatchdog) timedOut() error {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+
+	if wd.err != nil {
+		return wd.err
+	}
+	return nil
+}
+
+// watchedBody feeds reads of a streaming response body to its watchdog and
+// reports a watchdog abort as a timeout instead of "context canceled"
+type watchedBody struct {
+	io.ReadCloser
+	watchdog *streamWatchdog
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.watchdog.touch()
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		if timeoutErr := b.watchdog.timedOut(); timeoutErr != nil {
+			err = timeoutErr
+		}
+	}
+	return n, err
+}
+
+func (b *watchedBody) Close() error {
+	b.watchdog.stop()
+	err := b.ReadCloser.Close()
+	b.watchdog.cancel()
+	return err
+}
+
+// cancelOnClose releases the request context of a response once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// secondsOrDisabled converts a config value in seconds; negative values disable the timeout
+func secondsOrDisabled(seconds int) time.Duration {
+	if seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
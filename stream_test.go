@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testMessageStart = "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":10,\"output_tokens\":1}}}\n\n"
+	testContentDelta = "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"hi\"}}\n\n"
+	testMessageStop  = "event: message_delta\ndata: {\"type\":\"message_delta\",\"usage\":{\"output_tokens\":5}}\n\nevent: message_stop\ndata: {\"type\":\"message_stop\"}\n\n"
+)
+
+func TestAwaitContentTimeLimitWhileUpstreamSilent(t *testing.T) {
+	body, upstream := io.Pipe()
+	go func() {
+		io.WriteString(upstream, testMessageStart)
+		time.Sleep(500 * time.Millisecond)
+		io.WriteString(upstream, testContentDelta+testMessageStop)
+		upstream.Close()
+	}()
+
+	s := newSSEStream(body)
+	start := time.Now()
+	if err := s.awaitContent(context.Background(), 65536, 100*time.Millisecond); err != nil {
+		t.Fatalf("awaitContent: %v", err)
+	}
+	if waited := time.Since(start); waited > 400*time.Millisecond {
+		t.Fatalf("上游静默时 awaitContent 等待了 %s", waited)
+	}
+
+	// The read still running in the background must not lose data
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"text/event-stream"}}, Body: body}
+	rec := httptest.NewRecorder()
+	usage, err := (&ProxyServer{}).relayStream(context.Background(), rec, resp, s, slog.Default())
+	if err != nil {
+		t.Fatalf("relayStream: %v", err)
+	}
+	if got, want := rec.Body.String(), testMessageStart+testContentDelta+testMessageStop; got != want {
+		t.Errorf("客户端收到:\n%q\nwant:\n%q", got, want)
+	}
+	if usage.OutputTokens != 5 {
+		t.Errorf("output_tokens = %d, want 5", usage.OutputTokens)
+	}
+}
+
+func TestAwaitContentFailsOverOnEarlyEOF(t *testing.T) {
+	s := newSSEStream(io.NopCloser(strings.NewReader(testMessageStart)))
+	if err := s.awaitContent(context.Background(), 65536, time.Second); err == nil {
+		t.Fatal("流在内容前结束时应返回错误以便故障转移")
+	}
+}
+
+func TestRelayStreamClientGone(t *testing.T) {
+	body, upstream := io.Pipe()
+	go func() {
+		io.WriteString(upstream, testContentDelta)
+		upstream.CloseWithError(context.Canceled)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s := newSSEStream(body)
+	s.started = true
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"text/event-stream"}}, Body: body}
+	rec := httptest.NewRecorder()
+	if _, err := (&ProxyServer{}).relayStream(ctx, rec, resp, s, slog.Default()); err != errClientGone {
+		t.Fatalf("relayStream err = %v, want errClientGone", err)
+	}
+	if strings.Contains(rec.Body.String(), "event: error") {
+		t.Errorf("客户端断开后仍发送了错误事件: %q", rec.Body.String())
+	}
+}
+
+func TestClientCancelMidStreamKeepsBreakerClosed(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, testMessageStart+testContentDelta)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	ps, srv := newTestProxy(t, fmt.Sprintf(`{"backends": [{"name": "an", "base_url": %q, "enabled": true}]}`, upstream.URL))
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/v1/messages", strings.NewReader(`{"model":"m","stream":true,"messages":[]}`))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Cancel once the stream has started, like pressing Esc in the client
+		resp.Body.Read(make([]byte, 1))
+		cancel()
+		resp.Body.Close()
+
+		for start := time.Now(); ps.circuitBreaker.InFlight("an") != 0; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("代理未结束被取消的请求")
+			}
+		}
+	}
+	if state := ps.circuitBreaker.GetBackendState("an"); state.State != "closed" || state.ConsecutiveFailures != 0 {
+		t.Errorf("客户端取消被记为后端失败: state=%s consecutive_failures=%d", state.State, state.ConsecutiveFailures)
+	}
+}
+
+func TestRecordStreamResultIgnoresClientGone(t *testing.T) {
+	config := &Config{}
+	config.Backends = []Backend{{Name: "b", Enabled: true}}
+	config.Failover.CircuitBreaker.FailureThreshold = 3
+	ps := &ProxyServer{circuitBreaker: NewCircuitBreaker(config), metrics: NewMetrics()}
+	state := ps.circuitBreaker.states[0]
+
+	ps.recordStreamResult(state, "b", errors.New("流在 message_stop 前中断"))
+	for i := 0; i < 3; i++ {
+		if ps.recordStreamResult(state, "b", errClientGone) {
+			t.Fatal("客户端断开被报告为后端失败")
+		}
+	}
+	// Neither counted as a failure nor resetting the earlier one
+	if got := ps.circuitBreaker.GetBackendState("b"); got.State != "closed" || got.ConsecutiveFailures != 1 {
+		t.Errorf("state=%s consecutive_failures=%d, want closed 1", got.State, got.ConsecutiveFailures)
+	}
+}
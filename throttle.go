@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// tokenBucket is a local per-minute budget (requests or tokens) that refills
+// continuously, so a backend can be kept under contractual limits instead of
+// running into provider-side 429s
+type tokenBucket struct {
+	capacity float64 // Per-minute limit, also the burst size
+	tokens   float64 // May go negative when token usage is charged after the fact
+	last     time.Time
+}
+
+func newTokenBucket(perMinute int) *tokenBucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &tokenBucket{capacity: float64(perMinute), tokens: float64(perMinute), last: time.Now()}
+}
+
+// available returns the bucket level at now without modifying it
+func (b *tokenBucket) available(now time.Time) float64 {
+	elapsed := now.Sub(b.last)
+	if elapsed <= 0 {
+		return b.tokens
+	}
+	return math.Min(b.capacity, b.tokens+elapsed.Minutes()*b.capacity)
+}
+
+// waitFor returns how long until at least n units are available (0 = now)
+func (b *tokenBucket) waitFor(n float64, now time.Time) time.Duration {
+	missing := n - b.available(now)
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(missing / b.capacity * float64(time.Minute)))
+}
+
+// take removes n units, refilling up to now first
+func (b *tokenBucket) take(n float64, now time.Time) {
+	b.tokens = b.available(now) - n
+	b.last = now
+}
+
+// newLocalLimits creates the rpm/tpm buckets of a backend; nil means unlimited
+func newLocalLimits(backend Backend) (rpm, tpm *tokenBucket) {
+	return newTokenBucket(backend.RPM), newTokenBucket(backend.TPM)
+}
+
+// localLimitWait returns how long until the backend's local buckets admit a
+// request: one request slot, and a token budget that is not in debt.
+// Caller must hold stateMu.
+func localLimitWait(state *BackendState, now time.Time) time.Duration {
+	var wait time.Duration
+	if state.rpmBucket != nil {
+		wait = state.rpmBucket.waitFor(1, now)
+	}
+	if state.tpmBucket != nil {
+		wait = max(wait, state.tpmBucket.waitFor(1, now))
+	}
+	return wait
+}
+
+// TakeLocalLimit takes a request slot from the backend's local rpm/tpm limits.
+// It returns 0 on success, otherwise how long until a slot frees up.
+func (cb *CircuitBreaker) TakeLocalLimit(state *BackendState) time.Duration {
+	cb.stateMu.Lock()
+	defer cb.stateMu.Unlock()
+
+	now := time.Now()
+	if wait := localLimitWait(state, now); wait > 0 {
+		return wait
+	}
+	if state.rpmBucket != nil {
+		state.rpmBucket.take(1, now)
+	}
+	return 0
+}
+
+// ChargeTokens deducts the token usage of a finished request from the
+// backend's local tpm budget. Usage is only known afterwards, so the budget may
+// go into debt; no further requests are admitted until it has refilled.
+func (cb *CircuitBreaker) ChargeTokens(state *BackendState, usage tokenUsage) {
+	cb.stateMu.Lock()
+	defer cb.stateMu.Unlock()
+
+	if state.tpmBucket == nil {
+		return
+	}
+	total := usage.InputTokens + usage.OutputTokens + usage.CacheCreationTokens
+	if total > 0 {
+		state.tpmBucket.take(float64(total), time.Now())
+	}
+}
+
+// waitLocalLimit takes a request slot from the backend's local limits. When
+// the limits are exhausted it waits if a slot frees up before queueUntil (and
+// the request deadline), and otherwise reports false so the request moves on.
+func (ps *ProxyServer) waitLocalLimit(ctx context.Context, state *BackendState, queueUntil, deadline time.Time) (bool, time.Duration) {
+	var waited time.Duration
+	for {
+		wait := ps.circuitBreaker.TakeLocalLimit(state)
+		if wait == 0 {
+			return true, waited
+		}
+		if time.Now().Add(wait).After(queueUntil) || !sleepUntil(ctx, wait, deadline) {
+			return false, waited
+		}
+		waited += wait
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	if newTokenBucket(0) != nil {
+		t.Fatal("limit 0 应表示不限制")
+	}
+
+	b := newTokenBucket(60)
+	now := b.last
+	if wait := b.waitFor(60, now); wait != 0 {
+		t.Fatalf("新桶应为满: wait = %v", wait)
+	}
+	b.take(60, now)
+	if wait := b.waitFor(1, now); wait.Round(time.Millisecond) != time.Second {
+		t.Fatalf("60/min 的空桶等待 1 个单位 = %v, want 1s", wait)
+	}
+	if got := b.available(now.Add(30 * time.Second)); got != 30 {
+		t.Fatalf("30 秒后可用 = %v, want 30", got)
+	}
+	if got := b.available(now.Add(time.Hour)); got != 60 {
+		t.Fatalf("不应超过容量: %v", got)
+	}
+
+	// Token usage is charged after the fact and may push the bucket into debt
+	b.take(90, now.Add(time.Minute))
+	if wait := b.waitFor(1, now.Add(time.Minute)); wait.Round(time.Millisecond) != 31*time.Second {
+		t.Fatalf("欠额 30 时等待 = %v, want 31s", wait)
+	}
+}
+
+func TestLocalLimits(t *testing.T) {
+	config := &Config{}
+	config.Backends = []Backend{{Name: "b", Enabled: true, RPM: 2, TPM: 1000}}
+	cb := NewCircuitBreaker(config)
+	state := cb.states[0]
+
+	for i := 0; i < 2; i++ {
+		if wait := cb.TakeLocalLimit(state); wait != 0 {
+			t.Fatalf("第 %d 个请求被限流: %v", i+1, wait)
+		}
+	}
+	if wait := cb.TakeLocalLimit(state); wait <= 0 || wait > 30*time.Second {
+		t.Fatalf("rpm 用尽后 wait = %v, want (0, 30s]", wait)
+	}
+
+	// Exhausting tpm blocks the backend even with request slots left
+	cb = NewCircuitBreaker(config)
+	state = cb.states[0]
+	cb.ChargeTokens(state, tokenUsage{InputTokens: 900, OutputTokens: 200})
+	if wait := cb.TakeLocalLimit(state); wait <= 0 {
+		t.Fatal("tpm 欠额时不应放行")
+	}
+
+	// A slot that frees up after the queue time is not waited for
+	ps := &ProxyServer{circuitBreaker: cb}
+	ok, waited := ps.waitLocalLimit(context.Background(), state, time.Now().Add(10*time.Millisecond), time.Time{})
+	if ok || waited != 0 {
+		t.Fatalf("waitLocalLimit = %v, %v; want false, 0", ok, waited)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"time"
+)
+
+// backendClient is the HTTP client of one backend together with the settings it was built from
+type backendClient struct {
+	settings BackendTransport
+	client   *http.Client
+}
+
+// newBackendTransport builds a transport from Go's default transport with the backend's overrides
+func newBackendTransport(settings BackendTransport) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if settings.DialTimeout > 0 {
+		dialer := &net.Dialer{
+			Timeout:   time.Duration(settings.DialTimeout) * time.Second,
+			KeepAlive: 30 * time.Second,
+		}
+		transport.DialContext = dialer.DialContext
+	}
+	if settings.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = time.Duration(settings.TLSHandshakeTimeout) * time.Second
+	}
+	if settings.MaxIdleConns > 0 {
+		// Each backend has its own transport, so per-host and total limits are the same
+		transport.MaxIdleConns = settings.MaxIdleConns
+		transport.MaxIdleConnsPerHost = settings.MaxIdleConns
+	}
+
+	if settings.ProxyURL != "" {
+		proxyURL, err := url.Parse(settings.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("proxy_url 无效: %w", err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("proxy_url 不支持的协议: %q", proxyURL.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if settings.CAFile != "" || settings.ClientCertFile != "" || settings.ClientKeyFile != "" {
+		tlsConfig := &tls.Config{}
+		if settings.CAFile != "" {
+			pem, err := os.ReadFile(settings.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("读取 ca_file 失败: %w", err)
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("ca_file 中没有有效的 PEM 证书: %s", settings.CAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		if settings.ClientCertFile != "" || settings.ClientKeyFile != "" {
+			if settings.ClientCertFile == "" || settings.ClientKeyFile == "" {
+				return nil, fmt.Errorf("client_cert_file 和 client_key_file 必须同时设置")
+			}
+			cert, err := tls.LoadX509KeyPair(settings.ClientCertFile, settings.ClientKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("加载客户端证书失败: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	if settings.HTTP2 != nil && !*settings.HTTP2 {
+		// A non-nil empty TLSNextProto map turns off HTTP/2 negotiation
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return transport, nil
+}
+
+// buildBackendClients creates one HTTP client per backend. Clients whose
+// transport settings did not change are reused so a reload keeps their
+// connection pools; clients of removed or changed backends are drained.
+func buildBackendClients(config *Config, previous map[string]*backendClient) (map[string]*backendClient, error) {
+	clients := make(map[string]*backendClient, len(config.Backends))
+	for _, backend := range config.Backends {
+		if old, ok := previous[backend.Name]; ok && reflect.DeepEqual(old.settings, backend.Transport) {
+			clients[backend.Name] = old
+			continue
+		}
+		transport, err := newBackendTransport(backend.Transport)
+		if err != nil {
+			return nil, fmt.Errorf("后端 %s 的 transport 配置无效: %w", backend.Name, err)
+		}
+		clients[backend.Name] = &backendClient{
+			settings: backend.Transport,
+			// No client timeout: it would kill streaming responses. Timeouts are
+			// applied per request in forwardRequest.
+			client: &http.Client{Transport: transport},
+		}
+	}
+
+	for name, old := range previous {
+		if clients[name] != old {
+			old.client.CloseIdleConnections()
+			log.Printf("[连接池] %s - 已释放旧连接", name)
+		}
+	}
+	return clients, nil
+}
+
+// clientFor returns the HTTP client of a backend from a set built by buildBackendClients
+func (ps *ProxyServer) clientFor(clients map[string]*backendClient, name string) *http.Client {
+	if bc, ok := clients[name]; ok {
+		return bc.client
+	}
+	return ps.client
+}